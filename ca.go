@@ -1,27 +1,40 @@
 package main
 
 import (
+	"context"
 	"crypto"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/binary"
 	"encoding/json"
-	"encoding/pem"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"math/big"
+	"net/http"
+	"os"
+	"os/signal"
 	"strings"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/sys/unix"
 )
 
+// A CSR from sender, which is empty for offline signing. Source is
+// mqtt, est or empty. Over EST, the serial of the client certificate
+// is known and checked against revocations.
 type cacsr struct {
-	from string
-	csr  *x509.CertificateRequest
+	from       string
+	fromSerial string
+	source     string
+	csr        *x509.CertificateRequest
+	reply      func(cert *x509.Certificate, err error)
+}
+
+type caresult struct {
+	cert *x509.Certificate
+	err  error
 }
 
 type caconfig struct {
@@ -32,6 +45,54 @@ type caconfig struct {
 	Signcert string `json:"sign-cert"`
 	Signkey  string `json:"sign-key"`
 	Mqttsrv  string `json:"mqtt-server"`
+
+	// Passphrase of an encrypted sign-key
+	SignkeyPassphrase *kekconfig `json:"sign-key-passphrase"`
+
+	// When set, the signing key is kept in a PKCS#11 token
+	// instead of sign-key
+	SignPkcs11 *pkcs11config `json:"sign-pkcs11"`
+
+	// Optional EST server, using est-cert and est-key as its
+	// server certificate
+	EstListen string `json:"est-listen"`
+	EstCert   string `json:"est-cert"`
+	EstKey    string `json:"est-key"`
+
+	// Registry of one-time enrollment tokens. When set, a token
+	// is required for CSRs where the requested name differs
+	// from the sender.
+	EnrollmentTokens string `json:"enrollment-tokens"`
+
+	// Applies to the MQTT connection
+	Tls tlspolicy `json:"tls"`
+
+	// Extensions of the issued certificates
+	Profile certprofile `json:"profile"`
+
+	// Which names may be requested by whom
+	Policy capolicy `json:"policy"`
+
+	Crl cacrlconfig `json:"crl"`
+
+	// Rate limits and denylists
+	Limits calimits `json:"limits"`
+
+	// "counter" (the default) or "random"
+	Serials string `json:"serials"`
+
+	// MQTT client id, by default from the TLS certificate and the
+	// host name
+	ClientId string `json:"client-id"`
+
+	// Share the requests with other CA instances in this MQTT share
+	// group, using the same data directory
+	ShareGroup string `json:"share-group"`
+
+	// Hold CSRs from provisioning senders until approved with
+	// ca approve. Requests for a name that was issued for another
+	// key always need approval.
+	RequireApproval bool `json:"require-approval"`
 }
 
 func caFlags(flagset *flag.FlagSet, args *commonArgs) {
@@ -42,58 +103,208 @@ func caFlags(flagset *flag.FlagSet, args *commonArgs) {
 		"path to config file")
 }
 
-func caLoadSigncert(signcertpath string, signkeypath string) (*x509.Certificate, interface{}, error) {
-	signcertPem, err := ioutil.ReadFile(signcertpath)
+func caConfigLoad(configpath string) (caconfig, error) {
+	var config caconfig
+
+	configbytes, err := ioutil.ReadFile(configpath)
+	if err != nil {
+		return config, fmt.Errorf(
+			"failed to read %s: %w",
+			configpath,
+			err,
+		)
+	}
+
+	err = json.Unmarshal(configbytes, &config)
 	if err != nil {
-		return nil, nil, err
+		return config, fmt.Errorf(
+			"failed to parse JSON from %s: %w",
+			configpath,
+			err,
+		)
 	}
 
-	signkeyPem, err := ioutil.ReadFile(signkeypath)
+	err = config.Profile.check()
 	if err != nil {
-		return nil, nil, err
+		return config, fmt.Errorf("bad certificate profile in %s: %w", configpath, err)
 	}
 
-	block, rest := pem.Decode(signcertPem)
-	if len(rest) > 0 {
-		return nil, nil, fmt.Errorf("trailing garbage in %s", signcertpath)
+	err = config.Policy.check()
+	if err != nil {
+		return config, fmt.Errorf("bad policy in %s: %w", configpath, err)
 	}
 
-	signcert, err := x509.ParseCertificate(block.Bytes)
+	err = config.Limits.check()
 	if err != nil {
-		return nil, nil, err
+		return config, fmt.Errorf("bad limits in %s: %w", configpath, err)
 	}
 
-	block, rest = pem.Decode(signkeyPem)
-	if len(rest) > 0 {
-		return nil, nil, fmt.Errorf("trailing garbage in %s", signkeypath)
+	return config, nil
+}
+
+// Issues a certificate for a CSR, recording the CSR and the outcome
+// in the audit log. Nothing is issued unless it can be recorded: the
+// issuance is audited by caIssueChecked before the certificate is
+// added to the database, and other outcomes here.
+func caIssue(
+	config caconfig,
+	serials caserials,
+	signcert *x509.Certificate,
+	signkey crypto.Signer,
+	req cacsr,
+	duration time.Duration,
+) (*x509.Certificate, error) {
+	keySha256 := certKeyFingerprint(req.csr.RawSubjectPublicKeyInfo)
+	err := caauditCsr(config.Datadir, req, caauditReceived, "key "+keySha256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to audit CSR: %w", err)
 	}
 
-	signkey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	cert, err := caIssueChecked(config, serials, signcert, signkey, req, duration)
 	if err != nil {
-		return nil, nil, err
+		auditErr := caauditOutcome(config.Datadir, req, nil, err)
+		if auditErr != nil {
+			fmt.Println("Failed to audit CSR:", auditErr)
+		}
 	}
 
-	return signcert, signkey, nil
+	return cert, err
 }
 
-func caRun(configpath string, seconds int64) error {
-	configbytes, err := ioutil.ReadFile(configpath)
+// Applies the issuance checks to a CSR and signs it
+func caIssueChecked(
+	config caconfig,
+	serials caserials,
+	signcert *x509.Certificate,
+	signkey crypto.Signer,
+	req cacsr,
+	duration time.Duration,
+) (*x509.Certificate, error) {
+	commonName := req.csr.Subject.CommonName
+
+	keySha256 := certKeyFingerprint(req.csr.RawSubjectPublicKeyInfo)
+	err := config.Limits.deny(req.from, keySha256)
 	if err != nil {
-		return fmt.Errorf(
-			"failed to read %s: %w",
-			configpath,
-			err,
-		)
+		return nil, err
 	}
 
-	var config caconfig
-	err = json.Unmarshal(configbytes, &config)
+	err = req.csr.CheckSignature()
 	if err != nil {
-		return fmt.Errorf(
-			"failed to parse JSON from %s: %w",
-			configpath,
-			err,
-		)
+		return nil, fmt.Errorf("bad CSR signature: %w", err)
+	}
+
+	// Checking and recording happen under one lock, so that CA
+	// instances do not both sign the same CSR or hand out a name
+	// twice
+	unlock, err := cadbLock(config.Datadir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	issued, err := cadbIssuedFor(config.Datadir, req, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if issued != nil {
+		fmt.Println("CSR for", commonName, "was already signed as", issued.SerialNumber)
+		err = caauditOutcome(config.Datadir, req, issued, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to audit issuance: %w", err)
+		}
+		return issued, nil
+	}
+
+	err = config.Policy.allow(req.from, commonName)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(req.fromSerial) > 0 {
+		revoked, err := cadbIsRevoked(config.Datadir, req.fromSerial)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, capolicyReject("certificate %s of %s is revoked", req.fromSerial, req.from)
+		}
+	}
+
+	err = config.Limits.checkValid(config.Datadir, commonName, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	rekey, err := capolicyIsRekey(config.Datadir, req.from, commonName, keySha256)
+	if err != nil {
+		return nil, err
+	}
+
+	// Revocation frees the name, but a node whose certificate was
+	// revoked must not simply enroll again
+	revokedName, err := cadbLatestRevoked(config.Datadir, commonName)
+	if err != nil {
+		return nil, err
+	}
+
+	approvalReason := ""
+	if rekey {
+		approvalReason = "name was issued for another key"
+	} else if revokedName && len(req.from) > 0 {
+		approvalReason = "last certificate for the name was revoked"
+	} else if config.RequireApproval && len(req.from) > 0 && req.from != commonName {
+		approvalReason = "new enrollment"
+	}
+
+	// The token is bound to the key before the request may wait for
+	// approval, so that a copy of the token is useless to other keys
+	if len(config.EnrollmentTokens) > 0 && req.from != commonName {
+		err := enrolltokenConsume(config.EnrollmentTokens, req.csr)
+		if err != nil {
+			return nil, capolicyReject("%v", err)
+		}
+	}
+
+	var approved *capendingEntry
+	if len(approvalReason) > 0 {
+		approved, err = capendingCheck(config.Datadir, req, approvalReason)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := caSign(serials, signcert, signkey, req.csr, config.Profile, duration)
+	if err != nil {
+		return nil, err
+	}
+
+	if !certKeyEqual(cert.PublicKey, req.csr.PublicKey) {
+		return nil, fmt.Errorf("certificate was generated for the wrong key")
+	}
+
+	// A certificate in the database is handed out again on a
+	// repeated CSR, so it is audited first
+	err = caauditOutcome(config.Datadir, req, cert, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to audit issuance: %w", err)
+	}
+
+	err = cadbAdd(config.Datadir, req, cert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record issued certificate: %w", err)
+	}
+
+	if approved != nil {
+		capendingRemove(config.Datadir, approved.Id)
+	}
+
+	return cert, nil
+}
+
+func caRun(configpath string, seconds int64) error {
+	config, err := caConfigLoad(configpath)
+	if err != nil {
+		return err
 	}
 
 	rootcert, err := certLoadOneFromPath(config.Cacert)
@@ -122,36 +333,307 @@ func caRun(configpath string, seconds int64) error {
 
 	tlscert.Leaf = tlsleaf
 
-	signcert, signkey, err := caLoadSigncert(config.Signcert, config.Signkey)
+	signcert, signkey, err := caLoadSigncert(config)
 	if err != nil {
 		return err
 	}
 
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(config.Mqttsrv)
-	opts.SetAutoReconnect(false)
-	opts.SetUsername(tlsleaf.Subject.CommonName)
-	opts.SetTLSConfig(caTlsConfig(rootcert, tlscert))
+	if len(config.Mqttsrv) == 0 && len(config.EstListen) == 0 {
+		return fmt.Errorf("expected mqtt-server or est-listen to be configured")
+	}
 
-	client := mqtt.NewClient(opts)
+	csrs := make(chan cacsr)
+
+	var estServer *http.Server
+	if len(config.EstListen) > 0 {
+		estcert, err := tls.LoadX509KeyPair(config.EstCert, config.EstKey)
+		if err != nil {
+			return fmt.Errorf(
+				"failed to load key pair for EST from %s, %s: %w",
+				config.EstCert,
+				config.EstKey,
+				err,
+			)
+		}
+
+		estServer = caEstServer(
+			config.EstListen,
+			caEstTlsConfig(rootcert, estcert),
+			signcert,
+			rootcert,
+			csrs,
+		)
+
+		go func() {
+			fmt.Println("Serving EST on", config.EstListen)
+			err := estServer.ListenAndServeTLS("", "")
+			if err != http.ErrServerClosed {
+				fmt.Printf("EST server stopped: %v\n", err)
+			}
+		}()
+	}
+
+	revocations := make(chan carevocation)
+
+	topics := caTopicsFor(config, caClientId(config, tlscert))
+	reporter := careporterNew(topics.instance, config.Datadir)
+	limiter := calimiterNew(config.Limits)
+	limited := caauditLimited{}
+
+	var client mqtt.Client
+	if len(config.Mqttsrv) > 0 {
+		client, err = caConnectMqtt(config, topics, reporter, rootcert, tlscert, signcert, csrs, revocations)
+		if err != nil {
+			return err
+		}
+	}
 
-	clientConnect := client.Connect()
-	clientConnect.Wait()
-	err = clientConnect.Error()
+	serials, err := caserialsFromConfig(config)
 	if err != nil {
-		fmt.Printf("failed to connect: %s\n", err)
 		return err
 	}
+	decisions := time.NewTicker(10 * time.Second)
+
+	// The CRL is reissued half way to its next update, and when the
+	// records change, for example after ca revoke
+	var crlDue time.Time
+	var recordsChanged time.Time
+	issueCrl := func() {
+		if stat, err := os.Stat(cadbPath(config.Datadir)); err == nil {
+			recordsChanged = stat.ModTime()
+		}
 
-	csrs := make(chan cacsr)
+		crl, err := cacrlCreate(config, signcert, signkey, time.Now())
+		if err != nil {
+			fmt.Println("Failed to issue CRL:", err)
+			crlDue = time.Now().Add(time.Minute)
+			return
+		}
+		crlDue = crl.ThisUpdate.Add(crl.NextUpdate.Sub(crl.ThisUpdate) / 2)
+
+		where := []string{}
+		if len(config.Crl.File) > 0 {
+			err = cacrlWrite(config.Crl.File, crl)
+			if err != nil {
+				fmt.Println("Failed to write CRL:", err)
+			} else {
+				where = append(where, config.Crl.File)
+			}
+		}
+
+		if client != nil {
+			client.Publish(cacrlTopic, 1, true, crl.Raw)
+			where = append(where, cacrlTopic)
+		}
+
+		fmt.Printf("Issued CRL %s with %d entries\n", crl.Number, len(crl.Revoked))
+
+		if len(where) > 0 {
+			err = caauditCrlPublished(config.Datadir, crl, strings.Join(where, " and "))
+			if err != nil {
+				fmt.Println("Failed to audit CRL:", err)
+			}
+		}
+	}
+	issueCrl()
+	crlcheck := time.NewTicker(10 * time.Second)
+	statusUpdate := time.NewTicker(time.Minute)
+
+	// Decided requests are not rate limited, as they come from an
+	// operator rather than from the sender
+	handle := func(csr cacsr, limit bool) {
+		commonName := csr.csr.Subject.CommonName
+
+		fmt.Println("Received CSR for", commonName, "from", csr.from)
+
+		var err error
+		if limit {
+			err = limiter.allow(csr.from, time.Now())
+		}
+		var cert *x509.Certificate
+		if err == nil {
+			cert, err = caIssue(config, serials, signcert, signkey, csr, time.Duration(seconds)*time.Second)
+		} else {
+			limited.add(csr.from, time.Now())
+		}
+		reporter.count(err)
+
+		if _, isPending := err.(capendingError); isPending {
+			fmt.Printf("CSR for %s is %v\n", commonName, err)
+		} else if err != nil {
+			fmt.Printf("Rejected CSR for %s: %v\n", commonName, err)
+		}
+
+		csr.reply(cert, err)
+	}
+
+	flushLimited := func() {
+		err := limited.flush(config.Datadir)
+		if err != nil {
+			fmt.Println("Failed to audit rate limited CSRs:", err)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, unix.SIGTERM, unix.SIGINT)
+
+	// Closed once no more requests can arrive
+	var drained chan struct{}
+	var drainDeadline <-chan time.Time
+
+	for {
+		select {
+		case sig := <-signals:
+			if drained != nil {
+				continue
+			}
+			fmt.Printf("Got %v, finishing the requests in progress\n", sig)
+			drained = make(chan struct{})
+			drainDeadline = time.After(caDrainTimeout)
+			go caStopIntake(client, topics, reporter, estServer, drained)
+		case <-drained:
+			flushLimited()
+			caStopped(client, topics, reporter)
+			return nil
+		case <-drainDeadline:
+			fmt.Println("Gave up waiting for the requests in progress")
+			flushLimited()
+			caStopped(client, topics, reporter)
+			return nil
+		case csr := <-csrs:
+			handle(csr, true)
+		case r := <-revocations:
+			revoked, err := caRevokeRequested(config.Datadir, r)
+			if err != nil {
+				fmt.Println("Refused revocation:", err)
+				continue
+			}
+			for _, record := range revoked {
+				fmt.Printf("Revoked %s of %s on request: %s\n", record.Serial, record.CommonName, record.RevocationReason)
+			}
+			issueCrl()
+		case <-statusUpdate.C:
+			flushLimited()
+			if client != nil && client.IsConnectionOpen() && drained == nil {
+				client.Publish(topics.status, 1, true, reporter.payload())
+			}
+		case <-crlcheck.C:
+			stat, err := os.Stat(cadbPath(config.Datadir))
+			changed := err == nil && !stat.ModTime().Equal(recordsChanged)
+			if changed || time.Now().After(crlDue) {
+				issueCrl()
+			}
+		case <-decisions.C:
+			if client == nil || !client.IsConnectionOpen() || drained != nil {
+				continue
+			}
+
+			decided, err := capendingDecided(config.Datadir)
+			if err != nil {
+				fmt.Println("Failed to read pending requests:", err)
+				continue
+			}
+
+			for _, entry := range decided {
+				req, err := entry.request()
+				if err == nil {
+					req.reply = caMqttReply(client, req.from, signcert, req.csr)
+					handle(req, false)
+				} else {
+					fmt.Println(err)
+				}
+
+				// Acted on, whatever the outcome
+				capendingRemove(config.Datadir, entry.Id)
+			}
+		}
+	}
+}
 
-	csrSub := client.Subscribe("joonos/+/csr", 1, func(c mqtt.Client, m mqtt.Message) {
+// Topics of one CA instance. With a share group, requests are
+// subscribed to as an MQTT shared subscription, so that each goes to
+// one of the instances, and every instance has its own status topic.
+type catopics struct {
+	instance string
+	csr      string
+	revoke   string
+	status   string
+}
+
+func caTopicsFor(config caconfig, instance string) catopics {
+	topics := catopics{
+		instance: instance,
+		csr:      "joonos/+/csr",
+		revoke:   "joonos/+/revoke",
+		status:   "joonos-ca/status",
+	}
+
+	if len(config.ShareGroup) > 0 {
+		share := "$share/" + config.ShareGroup + "/"
+		topics.csr = share + topics.csr
+		topics.revoke = share + topics.revoke
+		topics.status = topics.status + "/" + instance
+	}
+
+	return topics
+}
+
+// How long to wait for requests in progress when stopping
+const caDrainTimeout = 30 * time.Second
+
+// Unique per CA process, so that persistent sessions of several
+// instances do not take over each other
+func caClientId(config caconfig, tlscert tls.Certificate) string {
+	if len(config.ClientId) > 0 {
+		return config.ClientId
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("joonos-ca-%s-%s", tlscert.Leaf.Subject.CommonName, hostname)
+}
+
+// Connects in the background and keeps reconnecting with backoff. The
+// subscriptions are renewed on every connect, and the session is kept
+// over disconnects so that requests published meanwhile are not lost.
+func caConnectMqtt(
+	config caconfig,
+	topics catopics,
+	reporter *careporter,
+	rootcert *x509.Certificate,
+	tlscert tls.Certificate,
+	signcert *x509.Certificate,
+	csrs chan<- cacsr,
+	revocations chan<- carevocation,
+) (mqtt.Client, error) {
+	clientId := topics.instance
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(config.Mqttsrv)
+	opts.SetClientID(clientId)
+	opts.SetCleanSession(false)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(5 * time.Second)
+	opts.SetMaxReconnectInterval(2 * time.Minute)
+	opts.SetUsername(tlscert.Leaf.Subject.CommonName)
+	opts.SetWill(topics.status, string(reporter.will()), 1, true)
+	tlsconf, err := caTlsConfig(rootcert, tlscert, config.Tls)
+	if err != nil {
+		return nil, fmt.Errorf("bad TLS policy: %w", err)
+	}
+	opts.SetTLSConfig(tlsconf)
+
+	onCsr := func(c mqtt.Client, m mqtt.Message) {
 		if len(m.Payload()) == 0 {
 			fmt.Println("ignoring empty message on", m.Topic())
 			return
 		}
 
-		sender, err := caSenderFromTopic(m.Topic())
+		sender, err := caSenderFromTopic(m.Topic(), "/csr")
 		if err != nil {
 			fmt.Printf("Failed to read sender: %v\n", err)
 			return
@@ -163,39 +645,116 @@ func caRun(configpath string, seconds int64) error {
 			return
 		}
 		csrs <- cacsr{
-			from: sender,
-			csr:  csr,
+			from:   sender,
+			source: "mqtt",
+			csr:    csr,
+			reply:  caMqttReply(c, sender, signcert, csr),
 		}
-	})
-	csrSub.Wait()
-	err = csrSub.Error()
-	if err != nil {
-		fmt.Printf("Failed to subscribe: %s\n", err)
-		return err
 	}
 
-	serials := caSerialChan(config.Datadir + "/serial")
+	onRevoke := func(c mqtt.Client, m mqtt.Message) {
+		sender, err := caSenderFromTopic(m.Topic(), "/revoke")
+		if err != nil {
+			fmt.Printf("Failed to read sender: %v\n", err)
+			return
+		}
 
-	for {
-		csr := <-csrs
+		var request revokeRequest
+		err = json.Unmarshal(m.Payload(), &request)
+		if err != nil {
+			fmt.Printf("Failed to parse revocation request from %s: %v\n", sender, err)
+			return
+		}
 
-		commonName := csr.csr.Subject.CommonName
+		revocations <- carevocation{sender: sender, request: request}
+	}
 
-		fmt.Println("Received CSR for", commonName, "from", csr.from)
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		fmt.Println("Connected to", config.Mqttsrv)
 
-		cert, err := caSign(serials, signcert, signkey, csr.csr, time.Duration(seconds)*time.Second)
+		subs := map[string]mqtt.MessageHandler{
+			topics.csr:    onCsr,
+			topics.revoke: onRevoke,
+		}
+		for topic, handler := range subs {
+			sub := c.Subscribe(topic, 1, handler)
+			sub.Wait()
+			if err := sub.Error(); err != nil {
+				fmt.Printf("Failed to subscribe to %s: %v\n", topic, err)
+			}
+		}
 
-		if err != nil {
-			fmt.Printf("Failed to generate certificate for %s: %v", commonName, err)
-			continue
+		c.Publish(topics.status, 1, true, reporter.enter("online"))
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		fmt.Printf("Lost connection to %s: %v\n", config.Mqttsrv, err)
+	})
+	opts.SetReconnectingHandler(func(c mqtt.Client, opts *mqtt.ClientOptions) {
+		fmt.Println("Reconnecting to", config.Mqttsrv)
+	})
+
+	client := mqtt.NewClient(opts)
+
+	fmt.Println("Connecting to", config.Mqttsrv, "as", clientId)
+	if !client.Connect().WaitTimeout(10 * time.Second) {
+		fmt.Println("Not connected yet, retrying in the background")
+	}
+
+	return client, nil
+}
+
+// Stops taking new requests, and returns once the ones which already
+// arrived have been handed over to the CA loop
+func caStopIntake(
+	client mqtt.Client,
+	topics catopics,
+	reporter *careporter,
+	estServer *http.Server,
+	drained chan<- struct{},
+) {
+	if client != nil && client.IsConnectionOpen() {
+		client.Publish(topics.status, 1, true, reporter.enter("stopping"))
+		client.Unsubscribe(topics.csr, topics.revoke).WaitTimeout(caDrainTimeout)
+	}
+
+	if estServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), caDrainTimeout)
+		defer cancel()
+		estServer.Shutdown(ctx)
+	}
+
+	close(drained)
+}
+
+func caStopped(client mqtt.Client, topics catopics, reporter *careporter) {
+	if client != nil {
+		if client.IsConnectionOpen() {
+			client.Publish(topics.status, 1, true, reporter.enter("offline")).WaitTimeout(5 * time.Second)
 		}
+		client.Disconnect(1000)
+	}
+	fmt.Println("CA stopped")
+}
+
+// Publishes the certificate for a CSR from sender, or the reason why
+// there is none
+func caMqttReply(
+	client mqtt.Client,
+	sender string,
+	signcert *x509.Certificate,
+	csr *x509.CertificateRequest,
+) func(cert *x509.Certificate, err error) {
+	return func(cert *x509.Certificate, err error) {
+		// A handled CSR does not stay retained. The node publishes
+		// it again when it retries.
+		defer client.Publish(fmt.Sprintf("joonos/%s/csr", sender), 1, true, []byte{})
 
-		if !certKeyEqual(cert.PublicKey, csr.csr.PublicKey) {
-			fmt.Println("Generated for the wrong key?")
-			continue
+		if err != nil {
+			caPublishRejection(client, sender, csr, err)
+			return
 		}
 
-		certTopic := fmt.Sprintf("joonos/%s/cert", csr.from)
+		certTopic := fmt.Sprintf("joonos/%s/cert", sender)
 
 		fmt.Println("Publishing cert", cert.SerialNumber, "of", cert.Subject.CommonName, "on", certTopic)
 
@@ -207,64 +766,61 @@ func caRun(configpath string, seconds int64) error {
 	}
 }
 
-func caSenderFromTopic(topic string) (string, error) {
-	prefix := "joonos/"
-	suffix := "/csr"
-	if !strings.HasPrefix(topic, prefix) {
-		return "", fmt.Errorf("expected topic to start with %s", prefix)
+// Tells the node that its CSR was rejected, or on csr/pending, that
+// it is waiting for approval
+func caPublishRejection(client mqtt.Client, sender string, csr *x509.CertificateRequest, reason error) {
+	payload, err := json.Marshal(carejection{
+		CommonName: csr.Subject.CommonName,
+		KeySha256:  certKeyFingerprint(csr.RawSubjectPublicKeyInfo),
+		Reason:     reason.Error(),
+	})
+	if err != nil {
+		return
 	}
 
-	if !strings.HasSuffix(topic, suffix) {
-		return "", fmt.Errorf("expected topic to end with %s", suffix)
+	topic := fmt.Sprintf("joonos/%s/csr/rejected", sender)
+	if _, isPending := reason.(capendingError); isPending {
+		topic = fmt.Sprintf("joonos/%s/csr/pending", sender)
 	}
 
-	return strings.TrimPrefix(strings.TrimSuffix(topic, suffix), prefix), nil
-}
-
-func caSerialChan(path string) <-chan uint64 {
-	state := caSerialInit(path)
-	buf := [8]byte{}
-	serials := make(chan uint64)
-
-	go func() {
-		for {
-			newSerial := state + 1
-			serials <- newSerial
-			state = newSerial
-			binary.LittleEndian.PutUint64(buf[:], newSerial)
-			ioutil.WriteFile(path, buf[:], 0600)
-		}
-	}()
-
-	return serials
+	fmt.Println("Publishing", reason, "on", topic)
+	client.Publish(topic, 1, false, payload)
 }
 
-func caSerialInit(path string) uint64 {
-	oldcontent, err := ioutil.ReadFile(path)
-	if err != nil {
-		return 1
+func caSenderFromTopic(topic string, suffix string) (string, error) {
+	prefix := "joonos/"
+	if !strings.HasPrefix(topic, prefix) {
+		return "", fmt.Errorf("expected topic to start with %s", prefix)
 	}
 
-	if len(oldcontent) != 8 {
-		return 1
+	if !strings.HasSuffix(topic, suffix) {
+		return "", fmt.Errorf("expected topic to end with %s", suffix)
 	}
 
-	return binary.LittleEndian.Uint64(oldcontent)
+	return strings.TrimPrefix(strings.TrimSuffix(topic, suffix), prefix), nil
 }
 
 func caSign(
-	serials <-chan uint64,
+	serials caserials,
 	signcert *x509.Certificate,
-	signkey crypto.PrivateKey,
+	signkey crypto.Signer,
 	csr *x509.CertificateRequest,
+	profile certprofile,
 	duration time.Duration,
 ) (*x509.Certificate, error) {
 	notBefore := time.Now().Add(-5 * time.Second)
 	notAfter := notBefore.Add(duration)
 
-	serial := big.NewInt(int64(<-serials))
+	serial, err := serials.next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate a serial: %w", err)
+	}
+
 	subject := pkix.Name{
-		CommonName: csr.Subject.CommonName,
+		CommonName:         csr.Subject.CommonName,
+		SerialNumber:       csr.Subject.SerialNumber,
+		Organization:       csr.Subject.Organization,
+		OrganizationalUnit: csr.Subject.OrganizationalUnit,
 	}
 	template := &x509.Certificate{
 		Subject:      subject,
@@ -273,6 +829,11 @@ func caSign(
 		NotAfter:     notAfter,
 	}
 
+	err = profile.apply(template, csr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply certificate profile: %w", err)
+	}
+
 	newcert, err := x509.CreateCertificate(
 		rand.Reader,
 		template,
@@ -293,6 +854,21 @@ func caSign(
 	return parsedCert, nil
 }
 
+func caSubcommands() []*subcommand {
+	return []*subcommand{
+		caInitSubcommand(),
+		caSignFileSubcommand(),
+		caSignBundleSubcommand(),
+		caPendingSubcommand(),
+		caApproveSubcommand(),
+		caRejectSubcommand(),
+		caListSubcommand(),
+		caShowSubcommand(),
+		caRevokeSubcommand(),
+		caAuditSubcommand(),
+	}
+}
+
 func caSubcommand() *subcommand {
 	flagset := flag.NewFlagSet("ca", flag.ExitOnError)
 	args := commonArgs{}
@@ -305,6 +881,26 @@ func caSubcommand() *subcommand {
 	)
 
 	run := func() error {
+		if flagset.NArg() > 0 {
+			// The subcommands have flags of their own, so these would
+			// be silently ignored
+			set := []string{}
+			flagset.Visit(func(f *flag.Flag) {
+				set = append(set, "-"+f.Name)
+			})
+			if len(set) > 0 {
+				return fmt.Errorf(
+					"%s must be given after the subcommand %s",
+					strings.Join(set, " and "),
+					flagset.Arg(0),
+				)
+			}
+
+			return runWithArgsAndSubcommands(
+				append([]string{"ca"}, flagset.Args()...),
+				caSubcommands(),
+			)
+		}
 		return caRun(args.config, *seconds)
 	}
 
@@ -315,7 +911,11 @@ func caSubcommand() *subcommand {
 	return &runCommand
 }
 
-func caTlsConfig(rootCert *x509.Certificate, tlscert tls.Certificate) *tls.Config {
+func caTlsConfig(
+	rootCert *x509.Certificate,
+	tlscert tls.Certificate,
+	policy tlspolicy,
+) (*tls.Config, error) {
 	rootCAs := x509.NewCertPool()
 	rootCAs.AddCert(rootCert)
 
@@ -324,5 +924,10 @@ func caTlsConfig(rootCert *x509.Certificate, tlscert tls.Certificate) *tls.Confi
 		RootCAs:      rootCAs,
 	}
 
-	return config
+	err := policy.apply(config, policy.Broker)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
 }
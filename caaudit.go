@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Audit trail of the CA decisions, in audit.log in the data directory.
+// Each line is a JSON entry holding the SHA-256 of the line before it,
+// and audit.head holds the sequence number and hash of the last line,
+// so that modified, removed or truncated entries break the chain. The
+// hashes are not keyed, so whoever can write the data directory can
+// rebuild the whole chain. That is only found out by comparing with a
+// head kept elsewhere, which is why the CA publishes it in its status.
+type caauditEntry struct {
+	Seq        uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	CommonName string    `json:"common-name,omitempty"`
+	Serial     string    `json:"serial,omitempty"`
+	Sender     string    `json:"sender,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+	Prev       string    `json:"prev"`
+}
+
+type caauditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+const (
+	caauditReceived    = "received"
+	caauditIssued      = "issued"
+	caauditPending     = "pending"
+	caauditRejected    = "rejected"
+	caauditRateLimited = "rate-limited"
+	caauditFailed      = "failed"
+	caauditApproved    = "approved"
+	caauditDenied      = "denied"
+	caauditRevoked     = "revoked"
+	caauditCrl         = "crl-published"
+)
+
+func caauditPath(datadir string) string {
+	return filepath.Join(datadir, "audit.log")
+}
+
+func caauditHeadPath(datadir string) string {
+	return filepath.Join(datadir, "audit.head")
+}
+
+func caauditHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+func caauditLoadHead(datadir string) (caauditHead, error) {
+	var head caauditHead
+
+	content, err := ioutil.ReadFile(caauditHeadPath(datadir))
+	if os.IsNotExist(err) {
+		return head, nil
+	}
+	if err != nil {
+		return head, err
+	}
+
+	err = json.Unmarshal(content, &head)
+	if err != nil {
+		return head, fmt.Errorf("failed to parse audit head: %w", err)
+	}
+
+	return head, nil
+}
+
+// The last line of the log, without the newline
+func caauditTail(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	offset := stat.Size() - 1<<16
+	if offset < 0 {
+		offset = 0
+	}
+
+	buf := make([]byte, stat.Size()-offset)
+	_, err = f.ReadAt(buf, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	buf = bytes.TrimSuffix(buf, []byte{'\n'})
+	return buf[bytes.LastIndexByte(buf, '\n')+1:], nil
+}
+
+// Appends an entry to the chain. Sequence, time and the link to the
+// previous entry are filled in here.
+func caauditAppend(datadir string, entry caauditEntry) error {
+	unlock, err := fsLock(filepath.Join(datadir, "audit.lock"))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	head, err := caauditLoadHead(datadir)
+	if err != nil {
+		return err
+	}
+
+	// After a crash between writing an entry and the head, the
+	// entry is taken as written
+	tail, err := caauditTail(caauditPath(datadir))
+	if err != nil {
+		return err
+	}
+	var last caauditEntry
+	if json.Unmarshal(tail, &last) == nil && last.Seq == head.Seq+1 && last.Prev == head.Hash {
+		head = caauditHead{Seq: last.Seq, Hash: caauditHash(tail)}
+	}
+
+	entry.Seq = head.Seq + 1
+	entry.Time = time.Now().UTC()
+	entry.Prev = head.Hash
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(caauditPath(datadir), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+
+	headBytes, err := json.Marshal(caauditHead{Seq: entry.Seq, Hash: caauditHash(line)})
+	if err != nil {
+		return err
+	}
+
+	return fsWriteFileAtomic(caauditHeadPath(datadir), headBytes, 0600)
+}
+
+func caauditCsr(datadir string, req cacsr, event string, detail string) error {
+	return caauditAppend(datadir, caauditEntry{
+		Event:      event,
+		CommonName: req.csr.Subject.CommonName,
+		Sender:     req.from,
+		Source:     req.source,
+		Detail:     detail,
+	})
+}
+
+// Records what became of a CSR, as returned by caIssue
+func caauditOutcome(datadir string, req cacsr, cert *x509.Certificate, err error) error {
+	if err == nil {
+		return caauditAppend(datadir, caauditEntry{
+			Event:      caauditIssued,
+			CommonName: req.csr.Subject.CommonName,
+			Serial:     cert.SerialNumber.String(),
+			Sender:     req.from,
+			Source:     req.source,
+			Detail:     "valid until " + cert.NotAfter.UTC().Format(time.RFC3339),
+		})
+	}
+
+	event := caauditFailed
+	switch err.(type) {
+	case capendingError:
+		event = caauditPending
+	case capolicyError:
+		event = caauditRejected
+	case calimitError:
+		event = caauditRateLimited
+	}
+
+	return caauditCsr(datadir, req, event, err.Error())
+}
+
+// Rate limited CSRs since the last entry about them. They are recorded
+// as one entry per window rather than one per CSR, so that a flood of
+// CSRs does not turn into a flood of writes to the log.
+type caauditLimited struct {
+	since    time.Time
+	count    int
+	bySender map[string]int
+}
+
+func (l *caauditLimited) add(sender string, now time.Time) {
+	if l.count == 0 {
+		l.since = now
+		l.bySender = map[string]int{}
+	}
+	l.count++
+	l.bySender[sender]++
+}
+
+// Records the CSRs counted so far, if any
+func (l *caauditLimited) flush(datadir string) error {
+	if l.count == 0 {
+		return nil
+	}
+
+	senders := make([]string, 0, len(l.bySender))
+	for sender := range l.bySender {
+		senders = append(senders, sender)
+	}
+	sort.Strings(senders)
+
+	counts := make([]string, len(senders))
+	for n, sender := range senders {
+		counts[n] = fmt.Sprintf("%d from %s", l.bySender[sender], sender)
+	}
+
+	err := caauditAppend(datadir, caauditEntry{
+		Event: caauditRateLimited,
+		Detail: fmt.Sprintf(
+			"%d CSRs since %s: %s",
+			l.count,
+			l.since.UTC().Format(time.RFC3339),
+			strings.Join(counts, ", "),
+		),
+	})
+	if err != nil {
+		return err
+	}
+
+	*l = caauditLimited{}
+	return nil
+}
+
+// Records revocations, by the sender when a node asked for them
+func caauditRevocations(datadir string, revoked []cadbRecord, sender string) error {
+	for _, record := range revoked {
+		err := caauditAppend(datadir, caauditEntry{
+			Event:      caauditRevoked,
+			CommonName: record.CommonName,
+			Serial:     record.Serial,
+			Sender:     sender,
+			Detail:     record.RevocationReason,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func caauditCrlPublished(datadir string, crl *cacrl, where string) error {
+	return caauditAppend(datadir, caauditEntry{
+		Event: caauditCrl,
+		Detail: fmt.Sprintf(
+			"number %s with %d entries to %s",
+			crl.Number,
+			len(crl.Revoked),
+			where,
+		),
+	})
+}
+
+// Walks the chain, returning the entries and the head of the log.
+// Any break in the chain is an error.
+func caauditLoad(datadir string) ([]caauditEntry, caauditHead, error) {
+	entries := []caauditEntry{}
+	last := caauditHead{}
+
+	content, err := ioutil.ReadFile(caauditPath(datadir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, last, err
+	}
+
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		return nil, last, fmt.Errorf("audit log ends in an incomplete entry")
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+
+		var entry caauditEntry
+		err = json.Unmarshal(line, &entry)
+		if err != nil {
+			return nil, last, fmt.Errorf("bad audit entry after %d: %w", last.Seq, err)
+		}
+
+		if entry.Seq != last.Seq+1 {
+			return nil, last, fmt.Errorf("audit entry %d follows %d", entry.Seq, last.Seq)
+		}
+
+		if entry.Prev != last.Hash {
+			return nil, last, fmt.Errorf("audit entry %d does not match the entry before it", entry.Seq)
+		}
+
+		entries = append(entries, entry)
+		last = caauditHead{Seq: entry.Seq, Hash: caauditHash(line)}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, last, err
+	}
+
+	head, err := caauditLoadHead(datadir)
+	if err != nil {
+		return nil, last, err
+	}
+
+	if head.Seq == last.Seq && head.Hash != last.Hash {
+		return nil, last, fmt.Errorf("audit entry %d does not match the head", last.Seq)
+	}
+
+	if head != last {
+		return nil, last, fmt.Errorf(
+			"audit log ends at entry %d, but the head is at entry %d",
+			last.Seq,
+			head.Seq,
+		)
+	}
+
+	return entries, last, nil
+}
+
+// Verifies the chain and, when given, that it still contains an entry
+// whose hash was recorded earlier
+func caAuditVerify(configpath string, contains string) error {
+	config, err := caConfigLoad(configpath)
+	if err != nil {
+		return err
+	}
+
+	entries, head, err := caauditLoad(config.Datadir)
+	if err != nil {
+		return fmt.Errorf("audit log is not intact: %w", err)
+	}
+
+	if len(contains) > 0 {
+		// Each entry holds the hash of the one before it
+		found := head.Hash == contains
+		for _, entry := range entries {
+			found = found || entry.Prev == contains
+		}
+		if !found {
+			return fmt.Errorf("audit log has no entry with hash %s", contains)
+		}
+	}
+
+	fmt.Printf("Audit log is intact with %d entries, head %s\n", len(entries), head.Hash)
+
+	return nil
+}
+
+// Which entries ca audit show prints
+type caauditFilter struct {
+	commonName string
+	serial     string
+	since      time.Time
+	until      time.Time
+}
+
+func (f caauditFilter) match(entry caauditEntry) bool {
+	if len(f.commonName) > 0 && entry.CommonName != f.commonName {
+		return false
+	}
+	if len(f.serial) > 0 && entry.Serial != f.serial {
+		return false
+	}
+	if !f.since.IsZero() && entry.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && entry.Time.After(f.until) {
+		return false
+	}
+	return true
+}
+
+func caAuditShow(configpath string, filter caauditFilter) error {
+	config, err := caConfigLoad(configpath)
+	if err != nil {
+		return err
+	}
+
+	entries, _, err := caauditLoad(config.Datadir)
+	if err != nil {
+		return fmt.Errorf("audit log is not intact: %w", err)
+	}
+
+	for _, entry := range entries {
+		if !filter.match(entry) {
+			continue
+		}
+
+		fmt.Printf("%-6d %s %-13s", entry.Seq, entry.Time.Format(time.RFC3339), entry.Event)
+		if len(entry.CommonName) > 0 {
+			fmt.Printf(" %s", entry.CommonName)
+		}
+		if len(entry.Serial) > 0 {
+			fmt.Printf(" serial %s", entry.Serial)
+		}
+		if len(entry.Sender) > 0 {
+			fmt.Printf(" from %s", entry.Sender)
+		}
+		if len(entry.Source) > 0 {
+			fmt.Printf(" via %s", entry.Source)
+		}
+		if len(entry.Detail) > 0 {
+			fmt.Printf(": %s", entry.Detail)
+		}
+		fmt.Println()
+	}
+
+	return nil
+}
+
+func caAuditVerifySubcommand() *subcommand {
+	flagset := flag.NewFlagSet("verify", flag.ExitOnError)
+	args := commonArgs{}
+	caFlags(flagset, &args)
+
+	contains := flagset.String("contains", "", "hash of an earlier last entry, which must still be in the log")
+
+	run := func() error {
+		return caAuditVerify(args.config, *contains)
+	}
+
+	verifyCommand := subcommand{
+		flagset: flagset,
+		run:     run,
+	}
+	return &verifyCommand
+}
+
+func caAuditShowSubcommand() *subcommand {
+	flagset := flag.NewFlagSet("show", flag.ExitOnError)
+	args := commonArgs{}
+	caFlags(flagset, &args)
+
+	commonName := flagset.String("cn", "", "only show entries for this common name")
+	serial := flagset.String("serial", "", "only show entries for this serial")
+	since := flagset.String("since", "", "only show entries from this time on, in RFC 3339")
+	until := flagset.String("until", "", "only show entries up to this time, in RFC 3339")
+
+	run := func() error {
+		filter := caauditFilter{commonName: *commonName, serial: *serial}
+
+		var err error
+		if len(*since) > 0 {
+			filter.since, err = time.Parse(time.RFC3339, *since)
+			if err != nil {
+				return fmt.Errorf("bad -since: %w", err)
+			}
+		}
+		if len(*until) > 0 {
+			filter.until, err = time.Parse(time.RFC3339, *until)
+			if err != nil {
+				return fmt.Errorf("bad -until: %w", err)
+			}
+		}
+
+		return caAuditShow(args.config, filter)
+	}
+
+	showCommand := subcommand{
+		flagset: flagset,
+		run:     run,
+	}
+	return &showCommand
+}
+
+func caAuditSubcommand() *subcommand {
+	flagset := flag.NewFlagSet("audit", flag.ExitOnError)
+
+	run := func() error {
+		return runWithArgsAndSubcommands(
+			append([]string{"audit"}, flagset.Args()...),
+			[]*subcommand{
+				caAuditVerifySubcommand(),
+				caAuditShowSubcommand(),
+			},
+		)
+	}
+
+	auditCommand := subcommand{
+		flagset: flagset,
+		run:     run,
+	}
+	return &auditCommand
+}
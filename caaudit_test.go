@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaauditChain(t *testing.T) {
+	datadir, err := ioutil.TempDir("", "caaudit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(datadir)
+
+	for _, cn := range []string{"node1", "node2", "node3"} {
+		err = caauditAppend(datadir, caauditEntry{Event: caauditReceived, CommonName: cn})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, _, err := caauditLoad(datadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[2].Seq != 3 {
+		t.Fatalf("Expected 3 entries, got %v", entries)
+	}
+
+	original, err := ioutil.ReadFile(caauditPath(datadir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(original, []byte{'\n'})
+
+	tampered := map[string][]byte{
+		"modified":  bytes.Replace(original, []byte("node2"), []byte("node9"), 1),
+		"last":      bytes.Replace(original, []byte("node3"), []byte("node9"), 1),
+		"removed":   append(append([]byte{}, lines[0]...), lines[2]...),
+		"truncated": append(append([]byte{}, lines[0]...), lines[1]...),
+		"emptied":   {},
+	}
+
+	for name, content := range tampered {
+		err = ioutil.WriteFile(caauditPath(datadir), content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = caauditLoad(datadir)
+		if err == nil {
+			t.Errorf("Expected the %s log to fail verification", name)
+		}
+	}
+
+	err = ioutil.WriteFile(caauditPath(datadir), original, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As after a crash between writing an entry and the head
+	head, err := caauditLoadHead(datadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headBytes, err := ioutil.ReadFile(caauditHeadPath(datadir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = caauditAppend(datadir, caauditEntry{Event: caauditReceived, CommonName: "node4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(caauditHeadPath(datadir), headBytes, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = caauditAppend(datadir, caauditEntry{Event: caauditReceived, CommonName: "node5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, last, err := caauditLoad(datadir)
+	if err != nil {
+		t.Fatalf("Expected the chain to continue after the crash, got %v", err)
+	}
+	if len(entries) != 5 || last.Seq != head.Seq+2 {
+		t.Errorf("Expected 5 entries, got %d", len(entries))
+	}
+}
+
+func TestCaauditLimited(t *testing.T) {
+	datadir, err := ioutil.TempDir("", "caaudit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(datadir)
+
+	limited := caauditLimited{}
+	now := time.Now()
+	for i := 0; i < 1000; i++ {
+		limited.add("unprovisioned", now)
+	}
+	limited.add("node1", now)
+
+	for i := 0; i < 2; i++ {
+		err = limited.flush(datadir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, _, err := caauditLoad(datadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("Expected one entry for the window, got %d", len(entries))
+	}
+
+	detail := entries[0].Detail
+	if !strings.Contains(detail, "1001 CSRs") || !strings.Contains(detail, "1000 from unprovisioned") {
+		t.Errorf("Expected the counts in the entry, got %s", detail)
+	}
+}
+
+func TestCaauditIssued(t *testing.T) {
+	datadir, err := ioutil.TempDir("", "caaudit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(datadir)
+
+	signcert, signkey := catestSigner(t)
+	config := caconfig{Datadir: datadir}
+	serials, err := caserialsFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Issued once, and handed out again on the repeated CSR
+	req := capendingTestRequest(t, "node1")
+	for i := 0; i < 2; i++ {
+		_, err = caIssue(config, serials, signcert, signkey, req, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, _, err := caauditLoad(datadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []string{caauditReceived, caauditIssued, caauditReceived, caauditIssued}
+	if len(entries) != len(events) {
+		t.Fatalf("Expected %d entries, got %v", len(events), entries)
+	}
+	for n, entry := range entries {
+		if entry.Event != events[n] {
+			t.Errorf("Expected entry %d to be %s, got %s", n, events[n], entry.Event)
+		}
+	}
+}
+
+func TestCaauditHeadInStatus(t *testing.T) {
+	datadir, err := ioutil.TempDir("", "caaudit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(datadir)
+
+	reporter := careporterNew("joonos-ca-admin-ca1", datadir)
+
+	var status castatus
+	err = json.Unmarshal(reporter.payload(), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.AuditHead != nil {
+		t.Errorf("Expected no audit head without a log, got %v", status.AuditHead)
+	}
+
+	err = caauditAppend(datadir, caauditEntry{Event: caauditReceived, CommonName: "node1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, head, err := caauditLoad(datadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = json.Unmarshal(reporter.payload(), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.AuditHead == nil || *status.AuditHead != head {
+		t.Errorf("Expected audit head %v in the status, got %v", head, status.AuditHead)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Offline provisioning bundles are directories named after the node,
+// as written by offline-provision -export. The CA signs the CSR and
+// adds the certificate chain to the bundle, which is then brought
+// back to the node for offline-provision -import.
+const (
+	bundleCsr        = "csr.pem"
+	bundleSysdesc    = "sysdesc.json"
+	bundleKeyPending = "key-pending"
+	bundleCert       = "cert.pem"
+)
+
+func caSignBundle(
+	config caconfig,
+	serials caserials,
+	signcert *x509.Certificate,
+	signkey crypto.Signer,
+	dir string,
+	duration time.Duration,
+) (*x509.Certificate, error) {
+	csrPem, err := ioutil.ReadFile(filepath.Join(dir, bundleCsr))
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := csrDecodePem(csrPem)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nobody vouches for the name in an offline bundle, so with
+	// enrollment tokens configured, the CSR has to carry one
+	cert, err := caIssue(config, serials, signcert, signkey, cacsr{csr: csr}, duration)
+	if err != nil {
+		return nil, err
+	}
+
+	err = certWriteChain(filepath.Join(dir, bundleCert), []*x509.Certificate{cert, signcert})
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+// Signs every bundle in dir which does not have a certificate yet
+func caSignBundles(configpath string, dir string, seconds int64) error {
+	config, err := caConfigLoad(configpath)
+	if err != nil {
+		return err
+	}
+
+	signcert, signkey, err := caLoadSigncert(config)
+	if err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	serials, err := caserialsFromConfig(config)
+	if err != nil {
+		return err
+	}
+	failures := 0
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		bundle := filepath.Join(dir, entry.Name())
+
+		_, err := os.Stat(filepath.Join(bundle, bundleCsr))
+		if err != nil {
+			continue
+		}
+
+		_, err = os.Stat(filepath.Join(bundle, bundleCert))
+		if err == nil {
+			fmt.Println("Already signed:", bundle)
+			continue
+		}
+
+		cert, err := caSignBundle(config, serials, signcert, signkey, bundle, time.Duration(seconds)*time.Second)
+		if err != nil {
+			fmt.Printf("Failed to sign %s: %v\n", bundle, err)
+			failures++
+			continue
+		}
+
+		fmt.Println("Signed", bundle+":", certDesc(cert))
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("failed to sign %d bundles", failures)
+	}
+
+	return nil
+}
+
+func caSignBundleSubcommand() *subcommand {
+	flagset := flag.NewFlagSet("sign-bundle", flag.ExitOnError)
+	args := commonArgs{}
+	caFlags(flagset, &args)
+
+	dir := flagset.String("dir", ".", "directory of bundles from offline-provision -export")
+	seconds := flagset.Int64(
+		"seconds",
+		30*86400,
+		"Lifetime of the certificates which are to be issued, in seconds",
+	)
+
+	run := func() error {
+		return caSignBundles(args.config, *dir, *seconds)
+	}
+
+	signCommand := subcommand{
+		flagset: flagset,
+		run:     run,
+	}
+	return &signCommand
+}
+
+// Signs a single CSR, from a file or stdin, and writes the leaf and
+// the signing certificate as PEM, ready for offline-provision
+func caSignFile(configpath string, csrpath string, outpath string, seconds int64) error {
+	config, err := caConfigLoad(configpath)
+	if err != nil {
+		return err
+	}
+
+	signcert, signkey, err := caLoadSigncert(config)
+	if err != nil {
+		return err
+	}
+
+	var csrPem []byte
+	if csrpath == "-" {
+		csrPem, err = offlineReadUntilEof(os.Stdin)
+	} else {
+		csrPem, err = ioutil.ReadFile(csrpath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read CSR: %w", err)
+	}
+
+	csr, err := csrDecodePem(csrPem)
+	if err != nil {
+		return err
+	}
+
+	serials, err := caserialsFromConfig(config)
+	if err != nil {
+		return err
+	}
+
+	cert, err := caIssue(config, serials, signcert, signkey, cacsr{csr: csr}, time.Duration(seconds)*time.Second)
+	if err != nil {
+		return fmt.Errorf("rejected CSR for %s: %w", csr.Subject.CommonName, err)
+	}
+
+	chain := []*x509.Certificate{cert, signcert}
+	if outpath == "-" {
+		for _, c := range chain {
+			pem.Encode(os.Stdout, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+		}
+	} else {
+		err = certWriteChain(outpath, chain)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "Signed", certDesc(cert))
+
+	return nil
+}
+
+func caSignFileSubcommand() *subcommand {
+	flagset := flag.NewFlagSet("sign", flag.ExitOnError)
+	args := commonArgs{}
+	caFlags(flagset, &args)
+
+	csrpath := flagset.String("csr", "-", "CSR in PEM, or - for stdin")
+	outpath := flagset.String("out", "-", "where to write the certificates, or - for stdout")
+	seconds := flagset.Int64(
+		"seconds",
+		30*86400,
+		"Lifetime of the certificate which is to be issued, in seconds",
+	)
+
+	run := func() error {
+		return caSignFile(args.config, *csrpath, *outpath, *seconds)
+	}
+
+	signCommand := subcommand{
+		flagset: flagset,
+		run:     run,
+	}
+	return &signCommand
+}
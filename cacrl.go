@@ -0,0 +1,395 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// The CRL is signed with the signing CA, published as DER on a
+// retained MQTT topic and optionally written to a file, PEM if the
+// name ends with .pem and otherwise DER. It is reissued when the
+// issuance records change and half way to its next update.
+type cacrlconfig struct {
+	File         string `json:"file"`
+	ValidSeconds int64  `json:"valid-seconds"`
+}
+
+const cacrlTopic = "joonos-ca/crl"
+
+const cacrlDefaultValidity = 7 * 24 * time.Hour
+
+// Reason codes from RFC 5280 5.3.1 which make sense for node
+// certificates
+var cacrlReasons = map[string]int{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+	"privilegeWithdrawn":   9,
+}
+
+func (c cacrlconfig) validity() time.Duration {
+	if c.ValidSeconds > 0 {
+		return time.Duration(c.ValidSeconds) * time.Second
+	}
+	return cacrlDefaultValidity
+}
+
+// Marks the valid certificates with the serial, or issued for the
+// name, as revoked
+func cadbRevoke(datadir string, query string, reason string) ([]cadbRecord, error) {
+	if _, known := cacrlReasons[reason]; !known {
+		return nil, fmt.Errorf("unknown revocation reason %s", reason)
+	}
+
+	unlock, err := cadbLock(datadir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	records, err := cadbLoad(datadir)
+	if err != nil {
+		return nil, err
+	}
+
+	matching := map[string]bool{}
+	for _, record := range cadbFind(records, query) {
+		matching[record.Serial] = true
+	}
+
+	now := time.Now().UTC()
+	revoked := []cadbRecord{}
+	for i := range records {
+		if !matching[records[i].Serial] || records[i].status(now) != cadbValid {
+			continue
+		}
+		records[i].Revoked = &now
+		records[i].RevocationReason = reason
+		revoked = append(revoked, records[i])
+	}
+
+	if len(revoked) == 0 {
+		return nil, fmt.Errorf("no valid certificate with serial or name %s", query)
+	}
+
+	return revoked, cadbSave(datadir, records)
+}
+
+func cadbIsRevoked(datadir string, serial string) (bool, error) {
+	records, err := cadbLoad(datadir)
+	if err != nil {
+		return false, err
+	}
+
+	for _, record := range records {
+		if record.Serial == serial {
+			return record.Revoked != nil, nil
+		}
+	}
+
+	return false, nil
+}
+
+// A signed CRL, as DER and the contents it was made from
+type cacrl struct {
+	Raw        []byte
+	Number     *big.Int
+	ThisUpdate time.Time
+	NextUpdate time.Time
+	Revoked    []pkix.RevokedCertificate
+}
+
+// CRLs are encoded here, as the crypto/x509 support for creating them
+// with extensions is newer than the Go version this builds with. The
+// issuer is copied as is from the signing certificate.
+type cacrlTbs struct {
+	Version             int
+	Signature           pkix.AlgorithmIdentifier
+	Issuer              asn1.RawValue
+	ThisUpdate          time.Time
+	NextUpdate          time.Time
+	RevokedCertificates []pkix.RevokedCertificate `asn1:"optional,omitempty"`
+	Extensions          []pkix.Extension          `asn1:"tag:0,explicit"`
+}
+
+type cacrlSigned struct {
+	TBSCertList        asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	SignatureValue     asn1.BitString
+}
+
+type cacrlAuthorityKeyId struct {
+	Id []byte `asn1:"optional,tag:0"`
+}
+
+var (
+	cacrlOidNumber         = asn1.ObjectIdentifier{2, 5, 29, 20}
+	cacrlOidReason         = asn1.ObjectIdentifier{2, 5, 29, 21}
+	cacrlOidAuthorityKeyId = asn1.ObjectIdentifier{2, 5, 29, 35}
+)
+
+// The signature algorithm for a signing key, and the hash it signs
+func cacrlSignatureAlgorithm(key crypto.PublicKey) (pkix.AlgorithmIdentifier, crypto.Hash, error) {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{
+			Algorithm:  asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11},
+			Parameters: asn1.NullRawValue,
+		}, crypto.SHA256, nil
+	case *ecdsa.PublicKey:
+		return pkix.AlgorithmIdentifier{
+			Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2},
+		}, crypto.SHA256, nil
+	case ed25519.PublicKey:
+		return pkix.AlgorithmIdentifier{
+			Algorithm: asn1.ObjectIdentifier{1, 3, 101, 112},
+		}, crypto.Hash(0), nil
+	}
+
+	return pkix.AlgorithmIdentifier{}, 0, fmt.Errorf("unsupported signing key %T", key)
+}
+
+// Signs a CRL of the revoked certificates which have not expired yet
+func cacrlCreate(
+	config caconfig,
+	signcert *x509.Certificate,
+	signkey crypto.Signer,
+	now time.Time,
+) (*cacrl, error) {
+	records, err := cadbLoad(config.Datadir)
+	if err != nil {
+		return nil, err
+	}
+
+	var revoked []pkix.RevokedCertificate
+	for _, record := range records {
+		if record.Revoked == nil || now.After(record.NotAfter) {
+			continue
+		}
+
+		serial, isNumber := new(big.Int).SetString(record.Serial, 10)
+		if !isNumber {
+			return nil, fmt.Errorf("bad serial %s in issuance records", record.Serial)
+		}
+
+		entry := pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: record.Revoked.UTC(),
+		}
+
+		// An unspecified reason is left out, as RFC 5280 advises
+		reason := cacrlReasons[record.RevocationReason]
+		if reason != 0 {
+			value, err := asn1.Marshal(asn1.Enumerated(reason))
+			if err != nil {
+				return nil, err
+			}
+			entry.Extensions = []pkix.Extension{{Id: cacrlOidReason, Value: value}}
+		}
+
+		revoked = append(revoked, entry)
+	}
+
+	crl := &cacrl{
+		// Increases with every CRL without keeping more state
+		Number:     big.NewInt(now.UnixNano()),
+		ThisUpdate: now.Add(-5 * time.Second).UTC(),
+		NextUpdate: now.Add(config.Crl.validity()).UTC(),
+		Revoked:    revoked,
+	}
+
+	algorithm, hash, err := cacrlSignatureAlgorithm(signkey.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	number, err := asn1.Marshal(crl.Number)
+	if err != nil {
+		return nil, err
+	}
+	extensions := []pkix.Extension{{Id: cacrlOidNumber, Value: number}}
+
+	if len(signcert.SubjectKeyId) > 0 {
+		keyId, err := asn1.Marshal(cacrlAuthorityKeyId{Id: signcert.SubjectKeyId})
+		if err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, pkix.Extension{Id: cacrlOidAuthorityKeyId, Value: keyId})
+	}
+
+	tbs, err := asn1.Marshal(cacrlTbs{
+		Version:             1,
+		Signature:           algorithm,
+		Issuer:              asn1.RawValue{FullBytes: signcert.RawSubject},
+		ThisUpdate:          crl.ThisUpdate,
+		NextUpdate:          crl.NextUpdate,
+		RevokedCertificates: revoked,
+		Extensions:          extensions,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	digest := tbs
+	if hash != 0 {
+		h := hash.New()
+		h.Write(tbs)
+		digest = h.Sum(nil)
+	}
+
+	signature, err := signkey.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign CRL: %w", err)
+	}
+
+	crl.Raw, err = asn1.Marshal(cacrlSigned{
+		TBSCertList:        asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: algorithm,
+		SignatureValue: asn1.BitString{
+			Bytes:     signature,
+			BitLength: 8 * len(signature),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// As a check of the encoding and of the signer
+	parsed, err := x509.ParseDERCRL(crl.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the signed CRL: %w", err)
+	}
+
+	err = signcert.CheckCRLSignature(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("signed CRL does not verify: %w", err)
+	}
+
+	return crl, nil
+}
+
+func cacrlWrite(path string, crl *cacrl) error {
+	content := crl.Raw
+	if strings.HasSuffix(path, ".pem") {
+		content = pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl.Raw})
+	}
+
+	return fsWriteFileAtomic(path, content, 0644)
+}
+
+// A revocation request from a node, published on joonos/<node>/revoke
+// when deprovisioning
+type carevocation struct {
+	sender  string
+	request revokeRequest
+}
+
+// Nodes may only revoke their own certificates
+func caRevokeRequested(datadir string, r carevocation) ([]cadbRecord, error) {
+	records, err := cadbLoad(datadir)
+	if err != nil {
+		return nil, err
+	}
+
+	found := cadbFind(records, r.request.Serial)
+	if len(found) != 1 || found[0].Serial != r.request.Serial {
+		return nil, fmt.Errorf("no certificate with serial %s", r.request.Serial)
+	}
+
+	if found[0].CommonName != r.sender {
+		return nil, fmt.Errorf("%s may not revoke the certificate of %s", r.sender, found[0].CommonName)
+	}
+
+	revoked, err := cadbRevoke(datadir, r.request.Serial, r.request.Reason)
+	if err != nil {
+		return nil, err
+	}
+
+	return revoked, caauditRevocations(datadir, revoked, r.sender)
+}
+
+// Revokes and rewrites the CRL file. A running CA notices the change
+// in the records and publishes a new CRL.
+func caRevoke(configpath string, query string, reason string) error {
+	config, err := caConfigLoad(configpath)
+	if err != nil {
+		return err
+	}
+
+	revoked, err := cadbRevoke(config.Datadir, query, reason)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range revoked {
+		fmt.Printf("Revoked %s of %s: %s\n", record.Serial, record.CommonName, reason)
+	}
+
+	err = caauditRevocations(config.Datadir, revoked, "")
+	if err != nil {
+		return err
+	}
+
+	if len(config.Crl.File) == 0 {
+		return nil
+	}
+
+	signcert, signkey, err := caLoadSigncert(config)
+	if err != nil {
+		return err
+	}
+
+	crl, err := cacrlCreate(config, signcert, signkey, time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = cacrlWrite(config.Crl.File, crl)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Wrote CRL to", config.Crl.File)
+
+	return caauditCrlPublished(config.Datadir, crl, config.Crl.File)
+}
+
+func caRevokeSubcommand() *subcommand {
+	flagset := flag.NewFlagSet("revoke", flag.ExitOnError)
+	args := commonArgs{}
+	caFlags(flagset, &args)
+
+	reason := flagset.String(
+		"reason",
+		"unspecified",
+		"keyCompromise, affiliationChanged, superseded, cessationOfOperation, privilegeWithdrawn or unspecified",
+	)
+
+	run := func() error {
+		if flagset.NArg() != 1 {
+			return fmt.Errorf("expected a serial or a common name")
+		}
+		return caRevoke(args.config, flagset.Arg(0), *reason)
+	}
+
+	revokeCommand := subcommand{
+		flagset: flagset,
+		run:     run,
+	}
+	return &revokeCommand
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCacrlRevoke(t *testing.T) {
+	datadir, err := ioutil.TempDir("", "cacrl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(datadir)
+
+	signkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sign"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: "sign"}}, signkey.Public(), signkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signcert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	later := time.Now().Add(time.Hour)
+	err = cadbSave(datadir, []cadbRecord{
+		{Serial: "2", CommonName: "node1", NotAfter: later},
+		{Serial: "3", CommonName: "node1", NotAfter: later},
+		{Serial: "4", CommonName: "node2", NotAfter: later},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = caRevokeRequested(datadir, carevocation{
+		sender:  "node1",
+		request: revokeRequest{Serial: "4", Reason: "cessationOfOperation"},
+	})
+	if err == nil {
+		t.Error("Expected node1 to be refused revoking the certificate of node2")
+	}
+
+	revoked, err := cadbRevoke(datadir, "node1", "keyCompromise")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 2 {
+		t.Errorf("Expected both certificates of node1 to be revoked, got %d", len(revoked))
+	}
+
+	_, err = cadbRevoke(datadir, "3", "keyCompromise")
+	if err == nil {
+		t.Error("Expected a revoked certificate to not be revoked again")
+	}
+
+	config := caconfig{Datadir: datadir}
+	crl, err := cacrlCreate(config, signcert, signkey, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := x509.ParseDERCRL(crl.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = signcert.CheckCRLSignature(parsed)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if parsed.TBSCertList.Version != 1 || len(parsed.TBSCertList.Extensions) == 0 {
+		t.Error("Expected a version 2 CRL with a CRL number")
+	}
+
+	serials := map[string]int{}
+	for _, entry := range parsed.TBSCertList.RevokedCertificates {
+		reason := 0
+		for _, extension := range entry.Extensions {
+			if extension.Id.Equal(cacrlOidReason) {
+				var code asn1.Enumerated
+				_, err = asn1.Unmarshal(extension.Value, &code)
+				if err != nil {
+					t.Fatal(err)
+				}
+				reason = int(code)
+			}
+		}
+		serials[entry.SerialNumber.String()] = reason
+	}
+	if len(serials) != 2 || serials["2"] != 1 || serials["3"] != 1 {
+		t.Errorf("Expected serials 2 and 3 revoked for key compromise, got %v", serials)
+	}
+}
+
+func TestCaIssueAfterRevocation(t *testing.T) {
+	datadir, err := ioutil.TempDir("", "cacrl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(datadir)
+
+	signcert, signkey := catestSigner(t)
+	config := caconfig{Datadir: datadir}
+	serials, err := caserialsFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := capendingTestRequest(t, "node1")
+	req.from = "node1"
+	_, err = caIssue(config, serials, signcert, signkey, req, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cadbRevoke(datadir, "node1", "keyCompromise")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The node asks again with its own identity
+	req = capendingTestRequest(t, "node1")
+	req.from = "node1"
+	_, err = caIssue(config, serials, signcert, signkey, req, time.Hour)
+	if _, isPending := err.(capendingError); !isPending {
+		t.Errorf("Expected a revoked name to need approval, got %v", err)
+	}
+}
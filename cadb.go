@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Every certificate the CA has issued, kept in issued.json in the
+// data directory. The records drive the rekey check, revocation and
+// the ca list and ca show commands.
+type cadbRecord struct {
+	Serial           string     `json:"serial"`
+	CommonName       string     `json:"common-name"`
+	Sender           string     `json:"sender"`
+	Source           string     `json:"source"`
+	KeySha256        string     `json:"key-sha256"`
+	NotBefore        time.Time  `json:"not-before"`
+	NotAfter         time.Time  `json:"not-after"`
+	Issued           time.Time  `json:"issued"`
+	Revoked          *time.Time `json:"revoked,omitempty"`
+	RevocationReason string     `json:"revocation-reason,omitempty"`
+	CsrSha256        string     `json:"csr-sha256"`
+	Cert             []byte     `json:"cert"`
+}
+
+// A CSR repeated within this time gets the certificate which was
+// already issued for it, for example when it arrives again after the
+// CA reconnects, or at another CA instance
+const cadbRepeatWindow = time.Hour
+
+const (
+	cadbValid   = "valid"
+	cadbRevoked = "revoked"
+	cadbExpired = "expired"
+)
+
+func (r cadbRecord) status(now time.Time) string {
+	if r.Revoked != nil {
+		return cadbRevoked
+	}
+	if now.After(r.NotAfter) {
+		return cadbExpired
+	}
+	return cadbValid
+}
+
+func cadbPath(datadir string) string {
+	return filepath.Join(datadir, "issued.json")
+}
+
+// Held while changing the records, the pending queue or the enrollment
+// tokens, so that CA instances sharing the data directory do not
+// interfere
+func cadbLock(datadir string) (func(), error) {
+	return fsLock(filepath.Join(datadir, "ca.lock"))
+}
+
+func cadbLoad(datadir string) ([]cadbRecord, error) {
+	records := []cadbRecord{}
+
+	content, err := ioutil.ReadFile(cadbPath(datadir))
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(content, &records)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", cadbPath(datadir), err)
+	}
+
+	return records, nil
+}
+
+func cadbSave(datadir string, records []cadbRecord) error {
+	content, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fsWriteFileAtomic(cadbPath(datadir), content, 0600)
+}
+
+func cadbCsrSha256(csr *x509.CertificateRequest) string {
+	sum := sha256.Sum256(csr.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Called with cadbLock held
+func cadbAdd(datadir string, req cacsr, cert *x509.Certificate) error {
+	records, err := cadbLoad(datadir)
+	if err != nil {
+		return err
+	}
+
+	records = append(records, cadbRecord{
+		Serial:     cert.SerialNumber.String(),
+		CommonName: cert.Subject.CommonName,
+		Sender:     req.from,
+		Source:     req.source,
+		KeySha256:  certKeyFingerprint(cert.RawSubjectPublicKeyInfo),
+		NotBefore:  cert.NotBefore,
+		NotAfter:   cert.NotAfter,
+		Issued:     time.Now().UTC(),
+		CsrSha256:  cadbCsrSha256(req.csr),
+		Cert:       cert.Raw,
+	})
+
+	return cadbSave(datadir, records)
+}
+
+// The certificate recently issued for the same CSR from the same
+// sender, if any. Called with cadbLock held.
+func cadbIssuedFor(datadir string, req cacsr, now time.Time) (*x509.Certificate, error) {
+	records, err := cadbLoad(datadir)
+	if err != nil {
+		return nil, err
+	}
+
+	csrSha256 := cadbCsrSha256(req.csr)
+	for _, record := range records {
+		if record.CsrSha256 != csrSha256 || record.Sender != req.from {
+			continue
+		}
+		if record.status(now) != cadbValid || now.Sub(record.Issued) > cadbRepeatWindow {
+			continue
+		}
+		return x509.ParseCertificate(record.Cert)
+	}
+
+	return nil, nil
+}
+
+// Records with the serial, or if there is none, for the common name
+func cadbFind(records []cadbRecord, query string) []cadbRecord {
+	for _, record := range records {
+		if record.Serial == query {
+			return []cadbRecord{record}
+		}
+	}
+
+	found := []cadbRecord{}
+	for _, record := range records {
+		if record.CommonName == query {
+			found = append(found, record)
+		}
+	}
+
+	return found
+}
+
+// Whether the certificate issued last for the name has been revoked
+func cadbLatestRevoked(datadir string, commonName string) (bool, error) {
+	records, err := cadbLoad(datadir)
+	if err != nil {
+		return false, err
+	}
+
+	var latest *cadbRecord
+	for i := range records {
+		if records[i].CommonName != commonName {
+			continue
+		}
+		if latest == nil || records[i].Issued.After(latest.Issued) {
+			latest = &records[i]
+		}
+	}
+
+	return latest != nil && latest.Revoked != nil, nil
+}
+
+// Where the CSR came from, for example "prov via mqtt"
+func (r cadbRecord) origin() string {
+	if len(r.Source) == 0 {
+		return "offline"
+	}
+	return r.Sender + " via " + r.Source
+}
+
+func cadbWriteLine(record cadbRecord, now time.Time) {
+	fmt.Printf(
+		"%-20s %-8s %-24s until %s, from %s, key %.16s\n",
+		record.Serial,
+		record.status(now),
+		record.CommonName,
+		record.NotAfter.Format(time.RFC3339),
+		record.origin(),
+		record.KeySha256,
+	)
+}
+
+func caListCerts(configpath string, status string) error {
+	config, err := caConfigLoad(configpath)
+	if err != nil {
+		return err
+	}
+
+	records, err := cadbLoad(config.Datadir)
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Issued.Before(records[j].Issued)
+	})
+
+	now := time.Now()
+	for _, record := range records {
+		if len(status) > 0 && record.status(now) != status {
+			continue
+		}
+		cadbWriteLine(record, now)
+	}
+
+	return nil
+}
+
+func caShowCerts(configpath string, query string) error {
+	config, err := caConfigLoad(configpath)
+	if err != nil {
+		return err
+	}
+
+	records, err := cadbLoad(config.Datadir)
+	if err != nil {
+		return err
+	}
+
+	found := cadbFind(records, query)
+	if len(found) == 0 {
+		return fmt.Errorf("no certificate with serial or name %s", query)
+	}
+
+	now := time.Now()
+	for _, record := range found {
+		fmt.Printf("Serial %s: %s\n", record.Serial, record.status(now))
+		fmt.Printf("  Issued:        %s\n", record.Issued.Format(time.RFC3339))
+		fmt.Printf("  From:          %s\n", record.origin())
+		if record.Revoked != nil {
+			fmt.Printf("  Revoked:       %s\n", record.Revoked.Format(time.RFC3339))
+			fmt.Printf("  Reason:        %s\n", record.RevocationReason)
+		}
+
+		cert, err := x509.ParseCertificate(record.Cert)
+		if err != nil {
+			fmt.Printf("  Bad certificate: %v\n", err)
+			continue
+		}
+		certinfoWriteText(os.Stdout, certinfoGet(cert))
+	}
+
+	return nil
+}
+
+func caListSubcommand() *subcommand {
+	flagset := flag.NewFlagSet("list", flag.ExitOnError)
+	args := commonArgs{}
+	caFlags(flagset, &args)
+
+	status := flagset.String("status", "", "only list certificates which are valid, revoked or expired")
+
+	run := func() error {
+		switch *status {
+		case "", cadbValid, cadbRevoked, cadbExpired:
+		default:
+			return fmt.Errorf("unknown status %s", *status)
+		}
+		return caListCerts(args.config, *status)
+	}
+
+	listCommand := subcommand{
+		flagset: flagset,
+		run:     run,
+	}
+	return &listCommand
+}
+
+func caShowSubcommand() *subcommand {
+	flagset := flag.NewFlagSet("show", flag.ExitOnError)
+	args := commonArgs{}
+	caFlags(flagset, &args)
+
+	run := func() error {
+		if flagset.NArg() != 1 {
+			return fmt.Errorf("expected a serial or a common name")
+		}
+		return caShowCerts(args.config, flagset.Arg(0))
+	}
+
+	showCommand := subcommand{
+		flagset: flagset,
+		run:     run,
+	}
+	return &showCommand
+}
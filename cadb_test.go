@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCadbFind(t *testing.T) {
+	now := time.Now()
+	revoked := now.Add(-time.Hour)
+
+	records := []cadbRecord{
+		{Serial: "1", CommonName: "node1", NotAfter: now.Add(-time.Minute)},
+		{Serial: "2", CommonName: "node1", NotAfter: now.Add(time.Hour), Revoked: &revoked},
+		{Serial: "3", CommonName: "node1", NotAfter: now.Add(time.Hour)},
+		{Serial: "4", CommonName: "2", NotAfter: now.Add(time.Hour)},
+	}
+
+	statuses := []string{cadbExpired, cadbRevoked, cadbValid, cadbValid}
+	for i, record := range records {
+		if record.status(now) != statuses[i] {
+			t.Errorf("Expected serial %s to be %s, got %s", record.Serial, statuses[i], record.status(now))
+		}
+	}
+
+	if found := cadbFind(records, "node1"); len(found) != 3 {
+		t.Errorf("Expected 3 certificates for node1, got %d", len(found))
+	}
+
+	found := cadbFind(records, "2")
+	if len(found) != 1 || found[0].CommonName != "node1" {
+		t.Errorf("Expected a serial to take precedence over a name, got %v", found)
+	}
+
+	if found := cadbFind(records, "5"); len(found) != 0 {
+		t.Errorf("Expected nothing for serial 5, got %v", found)
+	}
+}
+
+// A self-signed CA for signing in tests
+func catestSigner(t *testing.T) (*x509.Certificate, crypto.Signer) {
+	signkey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sign"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: "sign"}}, signkey.Public(), signkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signcert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signcert, signkey
+}
+
+func TestCaIssueOnce(t *testing.T) {
+	datadir, err := ioutil.TempDir("", "cadb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(datadir)
+
+	signcert, signkey := catestSigner(t)
+	config := caconfig{Datadir: datadir}
+	req := capendingTestRequest(t, "node1")
+
+	// Like two CA instances getting the same CSR
+	serials := make(chan string, 4)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			instanceSerials, _ := caserialsFromConfig(config)
+			cert, err := caIssue(config, instanceSerials, signcert, signkey, req, time.Hour)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			serials <- cert.SerialNumber.String()
+		}()
+	}
+	wg.Wait()
+	close(serials)
+
+	first := ""
+	for serial := range serials {
+		if len(first) == 0 {
+			first = serial
+		}
+		if serial != first {
+			t.Errorf("Expected the CSR to be signed once, got serials %s and %s", first, serial)
+		}
+	}
+
+	records, err := cadbLoad(datadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Errorf("Expected one record, got %d", len(records))
+	}
+}
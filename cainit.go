@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Bootstrapping of a whole PKI for a deployment or a test
+// environment: root and signing CAs, certificates for the broker, the
+// CA itself and unprovisioned nodes, and configuration for all of
+// them.
+
+type cainitParams struct {
+	dir         string
+	name        string
+	brokerNames []string
+	mqttServer  string
+	caUser      string
+	nodeDir     string
+	rootDays    int
+	signDays    int
+	days        int
+}
+
+type cainitPair struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+}
+
+func cainitIssue(template *x509.Certificate, issuer *cainitPair, bits int) (*cainitPair, error) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-5 * time.Minute)
+
+	parent := template
+	signkey := key
+	if issuer != nil {
+		parent = issuer.cert
+		signkey = issuer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signkey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue %s: %w", template.Subject.CommonName, err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cainitPair{cert: cert, key: key}, nil
+}
+
+func cainitCaTemplate(commonName string, days int, maxPathLen int) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		NotAfter:              time.Now().AddDate(0, 0, days),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            maxPathLen,
+		MaxPathLenZero:        maxPathLen == 0,
+	}
+}
+
+func cainitLeafTemplate(commonName string, days int, usage x509.ExtKeyUsage) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		NotAfter:              time.Now().AddDate(0, 0, days),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+	}
+}
+
+func cainitWritePair(dir string, name string, pair *cainitPair, chain ...*x509.Certificate) error {
+	err := certWriteChain(
+		filepath.Join(dir, name+".cert.pem"),
+		append([]*x509.Certificate{pair.cert}, chain...),
+	)
+	if err != nil {
+		return err
+	}
+
+	keyPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(pair.key),
+	})
+
+	return fsWriteFileAtomic(filepath.Join(dir, name+".key.pem"), keyPem, 0600)
+}
+
+func cainitWriteJson(path string, value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return fsWriteFileAtomic(path, append(content, '\n'), 0644)
+}
+
+func cainitMosquitto(p cainitParams, port string) string {
+	abs := func(name string) string {
+		return filepath.Join(p.dir, name)
+	}
+
+	return fmt.Sprintf(`per_listener_settings true
+
+listener %s
+cafile %s
+certfile %s
+keyfile %s
+require_certificate true
+tls_version tlsv1.2
+use_identity_as_username true
+crlfile %s
+acl_file %s
+`,
+		port,
+		abs("root.cert.pem"),
+		abs("broker.cert.pem"),
+		abs("broker.key.pem"),
+		abs("crl.pem"),
+		abs("mosquitto-acl.conf"),
+	)
+}
+
+func cainitMosquittoAcl(p cainitParams) string {
+	return fmt.Sprintf(`user %s
+topic read $SYS/#
+topic joonos/#
+topic joonos-ca/#
+
+pattern read joonos/%%u/#
+pattern write joonos/%%u/csr
+pattern write joonos/%%u/status/#
+pattern write joonos/%%u/revoke
+pattern read joonos-ca/crl
+`, p.caUser)
+}
+
+func caInit(p cainitParams) error {
+	dir, err := filepath.Abs(p.dir)
+	if err != nil {
+		return err
+	}
+	p.dir = dir
+
+	if len(p.brokerNames) == 0 {
+		return fmt.Errorf("expected at least one name for the broker")
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "root.key.pem"))
+	if err == nil {
+		return fmt.Errorf("%s already has a PKI, refusing to overwrite it", dir)
+	}
+
+	err = os.MkdirAll(filepath.Join(dir, "cadata"), 0700)
+	if err != nil {
+		return err
+	}
+
+	mqttServer := p.mqttServer
+	if len(mqttServer) == 0 {
+		mqttServer = "tls://" + net.JoinHostPort(p.brokerNames[0], "8883")
+	}
+	mqttUrl, err := url.Parse(mqttServer)
+	if err != nil {
+		return fmt.Errorf("bad MQTT server %s: %w", mqttServer, err)
+	}
+	port := mqttUrl.Port()
+	if len(port) == 0 {
+		port = "8883"
+	}
+
+	root, err := cainitIssue(cainitCaTemplate(p.name+" root CA", p.rootDays, 1), nil, 3072)
+	if err != nil {
+		return err
+	}
+
+	sign, err := cainitIssue(cainitCaTemplate(p.name+" signing CA", p.signDays, 0), root, 3072)
+	if err != nil {
+		return err
+	}
+
+	brokerTemplate := cainitLeafTemplate(p.brokerNames[0], p.days, x509.ExtKeyUsageServerAuth)
+	for _, name := range p.brokerNames {
+		if ip := net.ParseIP(name); ip != nil {
+			brokerTemplate.IPAddresses = append(brokerTemplate.IPAddresses, ip)
+		} else {
+			brokerTemplate.DNSNames = append(brokerTemplate.DNSNames, name)
+		}
+	}
+
+	broker, err := cainitIssue(brokerTemplate, sign, 2048)
+	if err != nil {
+		return err
+	}
+
+	caClient, err := cainitIssue(cainitLeafTemplate(p.caUser, p.days, x509.ExtKeyUsageClientAuth), sign, 2048)
+	if err != nil {
+		return err
+	}
+
+	prov, err := cainitIssue(cainitLeafTemplate("unprovisioned", p.days, x509.ExtKeyUsageClientAuth), sign, 2048)
+	if err != nil {
+		return err
+	}
+
+	pairs := []struct {
+		name  string
+		pair  *cainitPair
+		chain []*x509.Certificate
+	}{
+		{"root", root, nil},
+		{"sign", sign, nil},
+		{"broker", broker, []*x509.Certificate{sign.cert}},
+		{"ca-client", caClient, []*x509.Certificate{sign.cert}},
+		{"unprovisioned", prov, []*x509.Certificate{sign.cert}},
+	}
+	for _, pair := range pairs {
+		err = cainitWritePair(dir, pair.name, pair.pair, pair.chain...)
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", pair.name, err)
+		}
+	}
+
+	caconf := map[string]interface{}{
+		"ca-cert":        filepath.Join(dir, "root.cert.pem"),
+		"data-directory": filepath.Join(dir, "cadata"),
+		"tls-cert":       filepath.Join(dir, "ca-client.cert.pem"),
+		"tls-key":        filepath.Join(dir, "ca-client.key.pem"),
+		"sign-cert":      filepath.Join(dir, "sign.cert.pem"),
+		"sign-key":       filepath.Join(dir, "sign.key.pem"),
+		"mqtt-server":    mqttServer,
+		"crl":            map[string]string{"file": filepath.Join(dir, "crl.pem")},
+	}
+	err = cainitWriteJson(filepath.Join(dir, "ca.conf"), caconf)
+	if err != nil {
+		return err
+	}
+
+	// Mosquitto needs the CRL file to exist when it starts, and the
+	// CA keeps it up to date from then on
+	crlconfig := caconfig{
+		Datadir: filepath.Join(dir, "cadata"),
+		Crl:     cacrlconfig{File: filepath.Join(dir, "crl.pem")},
+	}
+	crl, err := cacrlCreate(crlconfig, sign.cert, sign.key, time.Now())
+	if err != nil {
+		return err
+	}
+	err = cacrlWrite(crlconfig.Crl.File, crl)
+	if err != nil {
+		return err
+	}
+
+	nodeconf := map[string]string{
+		"ca-cert":           filepath.Join(p.nodeDir, "root.cert.pem"),
+		"provisioning-cert": filepath.Join(p.nodeDir, "unprovisioned.cert.pem"),
+		"provisioning-key":  filepath.Join(p.nodeDir, "unprovisioned.key.pem"),
+		"data-directory":    "/var/lib/joonos",
+		"mqtt-server":       mqttServer,
+	}
+	err = cainitWriteJson(filepath.Join(dir, "joonos.conf"), nodeconf)
+	if err != nil {
+		return err
+	}
+
+	err = fsWriteFileAtomic(filepath.Join(dir, "mosquitto.conf"), []byte(cainitMosquitto(p, port)), 0644)
+	if err != nil {
+		return err
+	}
+
+	err = fsWriteFileAtomic(filepath.Join(dir, "mosquitto-acl.conf"), []byte(cainitMosquittoAcl(p)), 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Wrote a PKI to", dir)
+	fmt.Println("  CA configuration:   ", filepath.Join(dir, "ca.conf"))
+	fmt.Println("  Node configuration: ", filepath.Join(dir, "joonos.conf"))
+	fmt.Println("  Mosquitto listener: ", filepath.Join(dir, "mosquitto.conf"))
+	fmt.Printf("Nodes need root.cert.pem and unprovisioned.*.pem in %s.\n", p.nodeDir)
+	fmt.Println("Keep root.key.pem offline, it is not needed for running the CA.")
+
+	return nil
+}
+
+func caInitSubcommand() *subcommand {
+	flagset := flag.NewFlagSet("init", flag.ExitOnError)
+
+	p := cainitParams{}
+	brokerNames := ""
+
+	flagset.StringVar(&p.dir, "dir", ".", "directory to write the PKI and configuration to")
+	flagset.StringVar(&p.name, "name", "Joonos", "name of the deployment, used in CA names")
+	flagset.StringVar(&brokerNames, "broker-names", "", "comma-separated DNS names and IP addresses of the broker")
+	flagset.StringVar(&p.mqttServer, "mqtt-server", "", "MQTT server URL, by default tls://<first broker name>:8883")
+	flagset.StringVar(&p.caUser, "ca-user", "admin", "common name of the CA in its MQTT client certificate")
+	flagset.StringVar(&p.nodeDir, "node-dir", "/etc/joonos", "where nodes keep the certificates, for joonos.conf")
+	flagset.IntVar(&p.rootDays, "root-days", 3650, "lifetime of the root CA, in days")
+	flagset.IntVar(&p.signDays, "sign-days", 1825, "lifetime of the signing CA, in days")
+	flagset.IntVar(&p.days, "days", 397, "lifetime of the other certificates, in days")
+
+	run := func() error {
+		for _, name := range strings.Split(brokerNames, ",") {
+			name = strings.TrimSpace(name)
+			if len(name) > 0 {
+				p.brokerNames = append(p.brokerNames, name)
+			}
+		}
+		return caInit(p)
+	}
+
+	initCommand := subcommand{
+		flagset: flagset,
+		run:     run,
+	}
+	return &initCommand
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Nodes may write below joonos/<node>/, whatever name they are given,
+// so the topics of the CA must not be in there
+func TestCainitCaTopicsOutsideNodes(t *testing.T) {
+	for _, config := range []caconfig{{}, {ShareGroup: "joonos-ca"}} {
+		topics := caTopicsFor(config, "joonos-ca-admin-ca1")
+		for _, topic := range []string{topics.status, cacrlTopic} {
+			if strings.HasPrefix(topic, "joonos/") {
+				t.Errorf("CA topic %s is in the namespace of the nodes", topic)
+			}
+		}
+	}
+
+	acl := cainitMosquittoAcl(cainitParams{caUser: "admin"})
+	for _, line := range strings.Split(acl, "\n") {
+		if strings.HasPrefix(line, "pattern write ") &&
+			!strings.HasPrefix(line, "pattern write joonos/%u/") {
+			t.Errorf("nodes can write outside of their namespace: %s", line)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Protection against floods of CSRs, for example from a leaked
+// provisioning certificate. Rates are counted per CA instance over a
+// sliding window and apply to CSRs arriving over MQTT or EST. The
+// denylists and the cap on valid certificates per name apply to every
+// CSR.
+type calimits struct {
+	PerSender       calimit  `json:"per-sender"`
+	Global          calimit  `json:"global"`
+	MaxValidPerName int      `json:"max-valid-per-name"`
+	DeniedSenders   []string `json:"denied-senders"`
+	DeniedKeys      []string `json:"denied-keys"`
+}
+
+// At most Count CSRs in Seconds. Zero Count means no limit.
+type calimit struct {
+	Count   int   `json:"count"`
+	Seconds int64 `json:"seconds"`
+}
+
+// The CSR was not considered because of a rate limit
+type calimitError struct {
+	reason string
+}
+
+func (e calimitError) Error() string {
+	return e.reason
+}
+
+func (l calimit) window() time.Duration {
+	return time.Duration(l.Seconds) * time.Second
+}
+
+func (l calimits) check() error {
+	for _, limit := range []calimit{l.PerSender, l.Global} {
+		if limit.Count < 0 || (limit.Count > 0 && limit.Seconds <= 0) {
+			return fmt.Errorf("a rate limit needs a positive count and seconds")
+		}
+	}
+
+	if l.MaxValidPerName < 0 {
+		return fmt.Errorf("max-valid-per-name must not be negative")
+	}
+
+	return nil
+}
+
+// Refuses CSRs from denied senders and for denied keys
+func (l calimits) deny(sender string, keySha256 string) error {
+	if len(sender) > 0 && sliceContains(l.DeniedSenders, sender) {
+		return capolicyReject("%s is denied", sender)
+	}
+
+	if sliceContains(l.DeniedKeys, keySha256) {
+		return capolicyReject("key %s is denied", keySha256)
+	}
+
+	return nil
+}
+
+// Refuses a new certificate for a name which already has as many
+// valid ones as allowed. Called with cadbLock held.
+func (l calimits) checkValid(datadir string, commonName string, now time.Time) error {
+	if l.MaxValidPerName == 0 {
+		return nil
+	}
+
+	records, err := cadbLoad(datadir)
+	if err != nil {
+		return err
+	}
+
+	valid := 0
+	for _, record := range records {
+		if record.CommonName == commonName && record.status(now) == cadbValid {
+			valid++
+		}
+	}
+
+	if valid >= l.MaxValidPerName {
+		return capolicyReject("%s already has %d valid certificates", commonName, valid)
+	}
+
+	return nil
+}
+
+// Times of the recent CSRs, within the windows of the limits
+type calimiter struct {
+	limits   calimits
+	all      []time.Time
+	bySender map[string][]time.Time
+}
+
+func calimiterNew(limits calimits) *calimiter {
+	return &calimiter{
+		limits:   limits,
+		bySender: map[string][]time.Time{},
+	}
+}
+
+func calimiterPrune(times []time.Time, since time.Time) []time.Time {
+	kept := times[:0]
+	for _, t := range times {
+		if t.After(since) {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// Counts a CSR from sender, unless it is over a limit
+func (c *calimiter) allow(sender string, now time.Time) error {
+	global := c.limits.Global
+	if global.Count > 0 {
+		c.all = calimiterPrune(c.all, now.Add(-global.window()))
+		if len(c.all) >= global.Count {
+			return calimitError{reason: "too many CSRs, try again later"}
+		}
+	}
+
+	perSender := c.limits.PerSender
+	if perSender.Count > 0 {
+		for s, times := range c.bySender {
+			c.bySender[s] = calimiterPrune(times, now.Add(-perSender.window()))
+			if len(c.bySender[s]) == 0 {
+				delete(c.bySender, s)
+			}
+		}
+
+		if len(c.bySender[sender]) >= perSender.Count {
+			return calimitError{reason: fmt.Sprintf("too many CSRs from %s, try again later", sender)}
+		}
+		c.bySender[sender] = append(c.bySender[sender], now)
+	}
+
+	if global.Count > 0 {
+		c.all = append(c.all, now)
+	}
+
+	return nil
+}
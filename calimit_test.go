@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCalimiter(t *testing.T) {
+	limiter := calimiterNew(calimits{
+		PerSender: calimit{Count: 2, Seconds: 60},
+		Global:    calimit{Count: 3, Seconds: 60},
+	})
+
+	now := time.Now()
+	cases := []struct {
+		sender  string
+		at      time.Duration
+		allowed bool
+	}{
+		{"node1", 0, true},
+		{"node1", time.Second, true},
+		{"node1", 2 * time.Second, false},
+		{"node2", 3 * time.Second, true},
+		{"node3", 4 * time.Second, false},
+		{"node1", 61 * time.Second, true},
+		{"node3", 62 * time.Second, true},
+	}
+
+	for _, c := range cases {
+		err := limiter.allow(c.sender, now.Add(c.at))
+		if c.allowed && err != nil {
+			t.Errorf("Expected %s to be allowed at %s, got %v", c.sender, c.at, err)
+		}
+		if _, isLimited := err.(calimitError); !c.allowed && !isLimited {
+			t.Errorf("Expected %s to be limited at %s, got %v", c.sender, c.at, err)
+		}
+	}
+}
+
+func TestCalimitsCheckValid(t *testing.T) {
+	datadir, err := ioutil.TempDir("", "calimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(datadir)
+
+	now := time.Now()
+	err = cadbSave(datadir, []cadbRecord{
+		{Serial: "1", CommonName: "node1", NotAfter: now.Add(time.Hour)},
+		{Serial: "2", CommonName: "node1", NotAfter: now.Add(time.Hour)},
+		{Serial: "3", CommonName: "node2", NotAfter: now.Add(time.Hour)},
+		{Serial: "4", CommonName: "node2", NotAfter: now.Add(-time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limits := calimits{MaxValidPerName: 2, DeniedKeys: []string{"aaaa"}}
+
+	if limits.checkValid(datadir, "node1", now) == nil {
+		t.Error("Expected node1 to be at the cap")
+	}
+	if err := limits.checkValid(datadir, "node2", now); err != nil {
+		t.Errorf("Expected expired certificates to not count, got %v", err)
+	}
+	if limits.deny("node2", "aaaa") == nil {
+		t.Error("Expected a denied key to be refused")
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// CSRs waiting for an operator, kept as one JSON file per request in
+// data-directory/pending. The CA marks a request pending, `ca approve`
+// and `ca reject` record the decision, and the CA acts on it: right
+// away for requests which came over MQTT, or when the request is
+// repeated, for EST and offline signing.
+type capendingEntry struct {
+	Id         string    `json:"id"`
+	Received   time.Time `json:"received"`
+	Source     string    `json:"source"`
+	Sender     string    `json:"sender"`
+	CommonName string    `json:"common-name"`
+	KeySha256  string    `json:"key-sha256"`
+	Reason     string    `json:"reason"`
+	Status     string    `json:"status"`
+	Decision   string    `json:"decision,omitempty"`
+	Csr        []byte    `json:"csr"`
+}
+
+const (
+	capendingWaiting  = "pending"
+	capendingApproved = "approved"
+	capendingRejected = "rejected"
+)
+
+// The CSR was queued for approval. Not a rejection, the node is
+// expected to keep its CSR and wait.
+type capendingError struct {
+	id string
+}
+
+func (e capendingError) Error() string {
+	return fmt.Sprintf("waiting for approval as %s", e.id)
+}
+
+func capendingDir(datadir string) string {
+	return filepath.Join(datadir, "pending")
+}
+
+func capendingPath(datadir string, id string) string {
+	return filepath.Join(capendingDir(datadir), id+".json")
+}
+
+func capendingLoad(datadir string, id string) (capendingEntry, error) {
+	var entry capendingEntry
+
+	content, err := ioutil.ReadFile(capendingPath(datadir, id))
+	if err != nil {
+		return entry, err
+	}
+
+	err = json.Unmarshal(content, &entry)
+	return entry, err
+}
+
+func capendingSave(datadir string, entry capendingEntry) error {
+	err := os.MkdirAll(capendingDir(datadir), 0700)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fsWriteFileAtomic(capendingPath(datadir, entry.Id), content, 0600)
+}
+
+func capendingRemove(datadir string, id string) error {
+	return os.Remove(capendingPath(datadir, id))
+}
+
+func capendingList(datadir string) ([]capendingEntry, error) {
+	files, err := ioutil.ReadDir(capendingDir(datadir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []capendingEntry{}
+	for _, file := range files {
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		id := file.Name()[:len(file.Name())-len(".json")]
+		entry, err := capendingLoad(datadir, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pending request %s: %w", id, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Received.Before(entries[j].Received)
+	})
+
+	return entries, nil
+}
+
+// Finds the request with the same sender, name and key
+func capendingFind(datadir string, sender string, commonName string, keySha256 string) (*capendingEntry, error) {
+	entries, err := capendingList(datadir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.Sender == sender && entry.CommonName == commonName && entry.KeySha256 == keySha256 {
+			return &entry, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func capendingAdd(datadir string, req cacsr, reason string) (capendingEntry, error) {
+	idbytes := make([]byte, 8)
+	_, err := rand.Read(idbytes)
+	if err != nil {
+		return capendingEntry{}, err
+	}
+
+	entry := capendingEntry{
+		Id:         hex.EncodeToString(idbytes),
+		Received:   time.Now().UTC(),
+		Source:     req.source,
+		Sender:     req.from,
+		CommonName: req.csr.Subject.CommonName,
+		KeySha256:  certKeyFingerprint(req.csr.RawSubjectPublicKeyInfo),
+		Reason:     reason,
+		Status:     capendingWaiting,
+		Csr:        req.csr.Raw,
+	}
+
+	return entry, capendingSave(datadir, entry)
+}
+
+// Holds back a CSR which needs approval, or lets it through once it
+// has been approved
+func capendingCheck(datadir string, req cacsr, reason string) (*capendingEntry, error) {
+	commonName := req.csr.Subject.CommonName
+	keySha256 := certKeyFingerprint(req.csr.RawSubjectPublicKeyInfo)
+
+	entry, err := capendingFind(datadir, req.from, commonName, keySha256)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		added, err := capendingAdd(datadir, req, reason)
+		if err != nil {
+			return nil, fmt.Errorf("failed to queue CSR for approval: %w", err)
+		}
+		fmt.Printf("CSR for %s needs approval (%s), queued as %s\n", commonName, reason, added.Id)
+		return nil, capendingError{id: added.Id}
+	}
+
+	switch entry.Status {
+	case capendingApproved:
+		return entry, nil
+	case capendingRejected:
+		capendingRemove(datadir, entry.Id)
+		return nil, capolicyReject("rejected by the operator: %s", entry.Decision)
+	}
+
+	return nil, capendingError{id: entry.Id}
+}
+
+// Requests from MQTT which have been decided, for the CA to act on
+func capendingDecided(datadir string) ([]capendingEntry, error) {
+	entries, err := capendingList(datadir)
+	if err != nil {
+		return nil, err
+	}
+
+	decided := []capendingEntry{}
+	for _, entry := range entries {
+		if entry.Source == "mqtt" && entry.Status != capendingWaiting {
+			decided = append(decided, entry)
+		}
+	}
+
+	return decided, nil
+}
+
+func (e capendingEntry) request() (cacsr, error) {
+	csr, err := x509.ParseCertificateRequest(e.Csr)
+	if err != nil {
+		return cacsr{}, fmt.Errorf("bad CSR in pending request %s: %w", e.Id, err)
+	}
+
+	return cacsr{
+		from:   e.Sender,
+		source: e.Source,
+		csr:    csr,
+	}, nil
+}
+
+func capendingDecide(configpath string, id string, status string, decision string) error {
+	config, err := caConfigLoad(configpath)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := cadbLock(config.Datadir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entry, err := capendingLoad(config.Datadir, id)
+	if err != nil {
+		return fmt.Errorf("no pending request %s: %w", id, err)
+	}
+
+	if entry.Status != capendingWaiting {
+		return fmt.Errorf("request %s is already %s", id, entry.Status)
+	}
+
+	entry.Status = status
+	entry.Decision = decision
+
+	err = capendingSave(config.Datadir, entry)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Marked %s for %s as %s\n", id, entry.CommonName, status)
+
+	event := caauditApproved
+	if status == capendingRejected {
+		event = caauditDenied
+	}
+
+	detail := "request " + id
+	if len(decision) > 0 {
+		detail += ": " + decision
+	}
+
+	return caauditAppend(config.Datadir, caauditEntry{
+		Event:      event,
+		CommonName: entry.CommonName,
+		Sender:     entry.Sender,
+		Source:     entry.Source,
+		Detail:     detail,
+	})
+}
+
+func capendingShowList(configpath string) error {
+	config, err := caConfigLoad(configpath)
+	if err != nil {
+		return err
+	}
+
+	entries, err := capendingList(config.Datadir)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("No pending requests")
+		return nil
+	}
+
+	for _, entry := range entries {
+		fmt.Printf(
+			"%s %-8s %s %s from %s via %s, key %.16s: %s\n",
+			entry.Id,
+			entry.Status,
+			entry.Received.Format(time.RFC3339),
+			entry.CommonName,
+			entry.Sender,
+			entry.Source,
+			entry.KeySha256,
+			entry.Reason,
+		)
+	}
+
+	return nil
+}
+
+func caPendingSubcommand() *subcommand {
+	flagset := flag.NewFlagSet("pending", flag.ExitOnError)
+	args := commonArgs{}
+	caFlags(flagset, &args)
+
+	run := func() error {
+		if flagset.NArg() != 1 || flagset.Arg(0) != "list" {
+			return fmt.Errorf("expected pending list")
+		}
+		return capendingShowList(args.config)
+	}
+
+	pendingCommand := subcommand{
+		flagset: flagset,
+		run:     run,
+	}
+	return &pendingCommand
+}
+
+func caApproveSubcommand() *subcommand {
+	flagset := flag.NewFlagSet("approve", flag.ExitOnError)
+	args := commonArgs{}
+	caFlags(flagset, &args)
+
+	run := func() error {
+		if flagset.NArg() != 1 {
+			return fmt.Errorf("expected the id of a pending request")
+		}
+		return capendingDecide(args.config, flagset.Arg(0), capendingApproved, "")
+	}
+
+	approveCommand := subcommand{
+		flagset: flagset,
+		run:     run,
+	}
+	return &approveCommand
+}
+
+func caRejectSubcommand() *subcommand {
+	flagset := flag.NewFlagSet("reject", flag.ExitOnError)
+	args := commonArgs{}
+	caFlags(flagset, &args)
+
+	reason := flagset.String("reason", "not approved", "reason reported to the node")
+
+	run := func() error {
+		if flagset.NArg() != 1 {
+			return fmt.Errorf("expected the id of a pending request")
+		}
+		return capendingDecide(args.config, flagset.Arg(0), capendingRejected, *reason)
+	}
+
+	rejectCommand := subcommand{
+		flagset: flagset,
+		run:     run,
+	}
+	return &rejectCommand
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func capendingTestRequest(t *testing.T, commonName string) cacsr {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cacsr{from: "unprovisioned", source: "mqtt", csr: csr}
+}
+
+func TestCapendingCheck(t *testing.T) {
+	datadir, err := ioutil.TempDir("", "capending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(datadir)
+
+	approve := capendingTestRequest(t, "node1")
+	reject := capendingTestRequest(t, "node2")
+
+	ids := map[string]string{}
+	for _, req := range []cacsr{approve, reject, approve} {
+		_, err := capendingCheck(datadir, req, "new enrollment")
+		pending, isPending := err.(capendingError)
+		if !isPending {
+			t.Fatalf("Expected %s to wait for approval, got %v", req.csr.Subject.CommonName, err)
+		}
+
+		commonName := req.csr.Subject.CommonName
+		if id, seen := ids[commonName]; seen && id != pending.id {
+			t.Errorf("Expected a repeated CSR to keep id %s, got %s", id, pending.id)
+		}
+		ids[commonName] = pending.id
+	}
+
+	entries, err := capendingList(datadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 pending requests, got %d", len(entries))
+	}
+
+	for _, entry := range entries {
+		switch entry.CommonName {
+		case "node1":
+			entry.Status = capendingApproved
+		case "node2":
+			entry.Status = capendingRejected
+			entry.Decision = "unknown device"
+		}
+		err = capendingSave(datadir, entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	decided, err := capendingDecided(datadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decided) != 2 {
+		t.Errorf("Expected 2 decided requests, got %d", len(decided))
+	}
+
+	entry, err := capendingCheck(datadir, approve, "new enrollment")
+	if err != nil || entry == nil || entry.Id != ids["node1"] {
+		t.Errorf("Expected node1 to be approved, got %v, %v", entry, err)
+	}
+
+	_, err = capendingCheck(datadir, reject, "new enrollment")
+	if _, isPolicy := err.(capolicyError); !isPolicy {
+		t.Errorf("Expected node2 to be rejected, got %v", err)
+	}
+
+	_, err = capendingLoad(datadir, ids["node2"])
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected the rejected request to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// Rules for which names the CA issues certificates for. A node may
+// only request its own name, unless it connects as one of the
+// provisioning senders, which are also reserved as names.
+type capolicy struct {
+	ProvisioningSenders []string `json:"provisioning-senders"`
+	NamePattern         string   `json:"name-pattern"`
+	AllowedNames        []string `json:"allowed-names"`
+	ReservedNames       []string `json:"reserved-names"`
+}
+
+var capolicyDefaultProvisioningSenders = []string{"unprovisioned"}
+
+// Reason for refusing a CSR, reported back to the node
+type capolicyError struct {
+	reason string
+}
+
+func (e capolicyError) Error() string {
+	return e.reason
+}
+
+func capolicyReject(format string, args ...interface{}) error {
+	return capolicyError{reason: fmt.Sprintf(format, args...)}
+}
+
+// Published on joonos/<sender>/csr/rejected
+type carejection struct {
+	CommonName string `json:"common-name"`
+	KeySha256  string `json:"key-sha256"`
+	Reason     string `json:"reason"`
+}
+
+func (r carejection) Error() string {
+	return fmt.Sprintf("CA rejected the CSR for %s: %s", r.CommonName, r.Reason)
+}
+
+func (p capolicy) provisioningSenders() []string {
+	if p.ProvisioningSenders == nil {
+		return capolicyDefaultProvisioningSenders
+	}
+	return p.ProvisioningSenders
+}
+
+func (p capolicy) check() error {
+	_, err := regexp.Compile(p.NamePattern)
+	if err != nil {
+		return fmt.Errorf("bad name-pattern: %w", err)
+	}
+	return nil
+}
+
+// Checks a request for commonName from sender, which is empty for
+// requests that did not arrive over the network
+func (p capolicy) allow(sender string, commonName string) error {
+	if len(commonName) == 0 {
+		return capolicyReject("empty common name")
+	}
+
+	if sliceContains(p.provisioningSenders(), commonName) || sliceContains(p.ReservedNames, commonName) {
+		return capolicyReject("%s is a reserved name", commonName)
+	}
+
+	if len(sender) > 0 && sender != commonName && !sliceContains(p.provisioningSenders(), sender) {
+		return capolicyReject("%s may not request a certificate for %s", sender, commonName)
+	}
+
+	if len(p.NamePattern) > 0 {
+		matched, err := regexp.MatchString("^(?:"+p.NamePattern+")$", commonName)
+		if err != nil || !matched {
+			return capolicyReject("%s does not match the allowed names", commonName)
+		}
+	}
+
+	if len(p.AllowedNames) > 0 && !sliceContains(p.AllowedNames, commonName) {
+		return capolicyReject("%s is not in the allowed names", commonName)
+	}
+
+	return nil
+}
+
+// The key each name was last issued for, from the issuance records.
+// Revoked certificates leave the name free. Older CAs kept this in
+// names.json in the data directory, which is still read.
+type canames map[string]string
+
+func canamesPath(datadir string) string {
+	return filepath.Join(datadir, "names.json")
+}
+
+func canamesLoad(datadir string) (canames, error) {
+	names := canames{}
+
+	content, err := ioutil.ReadFile(canamesPath(datadir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(content, &names)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", canamesPath(datadir), err)
+		}
+	}
+
+	records, err := cadbLoad(datadir)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Issued.Before(records[j].Issued)
+	})
+
+	for _, record := range records {
+		if record.Revoked != nil {
+			if names[record.CommonName] == record.KeySha256 {
+				delete(names, record.CommonName)
+			}
+			continue
+		}
+		names[record.CommonName] = record.KeySha256
+	}
+
+	return names, nil
+}
+
+// A name held by one key may be taken over by another key only by
+// the holder itself, for example when rotating the key on renewal.
+// Otherwise the request needs approval.
+func capolicyIsRekey(datadir string, sender string, commonName string, keySha256 string) (bool, error) {
+	if sender == commonName {
+		return false, nil
+	}
+
+	names, err := canamesLoad(datadir)
+	if err != nil {
+		return false, err
+	}
+
+	issued, found := names[commonName]
+	return found && issued != keySha256, nil
+}
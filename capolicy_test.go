@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCapolicyAllow(t *testing.T) {
+	policy := capolicy{
+		NamePattern:   "node[0-9]+",
+		ReservedNames: []string{"node0"},
+	}
+
+	cases := []struct {
+		sender     string
+		commonName string
+		allowed    bool
+	}{
+		{"node1", "node1", true},
+		{"unprovisioned", "node2", true},
+		{"", "node3", true},
+		{"node1", "node2", false},
+		{"unprovisioned", "unprovisioned", false},
+		{"unprovisioned", "node0", false},
+		{"unprovisioned", "gateway", false},
+		{"unprovisioned", "", false},
+	}
+
+	for _, c := range cases {
+		err := policy.allow(c.sender, c.commonName)
+		if c.allowed && err != nil {
+			t.Errorf("Expected %s to get %s, got %v", c.sender, c.commonName, err)
+		}
+		if !c.allowed && err == nil {
+			t.Errorf("Expected %s to be refused %s", c.sender, c.commonName)
+		}
+	}
+}
+
+func TestCapolicyRekey(t *testing.T) {
+	datadir, err := ioutil.TempDir("", "capolicy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(datadir)
+
+	revoked := time.Now()
+	err = cadbSave(datadir, []cadbRecord{
+		{Serial: "1", CommonName: "node1", KeySha256: "aaaa"},
+		{Serial: "2", CommonName: "node3", KeySha256: "cccc", Revoked: &revoked},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		sender     string
+		commonName string
+		keySha256  string
+		rekey      bool
+	}{
+		{"unprovisioned", "node1", "aaaa", false},
+		{"node1", "node1", "bbbb", false},
+		{"unprovisioned", "node1", "bbbb", true},
+		{"unprovisioned", "node2", "bbbb", false},
+		{"unprovisioned", "node3", "bbbb", false},
+	}
+
+	for _, c := range cases {
+		rekey, err := capolicyIsRekey(datadir, c.sender, c.commonName, c.keySha256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rekey != c.rekey {
+			t.Errorf("Expected rekey %v for %+v", c.rekey, c)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+)
+
+// Source of serial numbers for issued certificates. Serials are
+// stored before they are used, so that a crash can not lead to one
+// being used twice.
+type caserials interface {
+	next() (*big.Int, error)
+}
+
+// A counter in data-directory/serial, as 8 little-endian bytes. Every
+// serial is read and incremented under a lock on serial.lock, so CA
+// commands sharing the directory do not collide. Should the counter
+// be lost, it continues from the highest serial in the records.
+type caserialsCounter struct {
+	datadir string
+}
+
+// Random 128-bit serials, checked against the issuance records
+type caserialsRandom struct {
+	datadir string
+}
+
+func caserialsFromConfig(config caconfig) (caserials, error) {
+	switch config.Serials {
+	case "", "counter":
+		return caserialsCounter{datadir: config.Datadir}, nil
+	case "random":
+		return caserialsRandom{datadir: config.Datadir}, nil
+	}
+
+	return nil, fmt.Errorf("unknown serial allocation %s", config.Serials)
+}
+
+func (c caserialsCounter) next() (*big.Int, error) {
+	path := filepath.Join(c.datadir, "serial")
+
+	unlock, err := fsLock(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read serial: %w", err)
+	}
+
+	var serial uint64
+	if len(content) == 8 {
+		serial = binary.LittleEndian.Uint64(content)
+	} else {
+		serial, err = caserialsHighest(c.datadir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	serial++
+	buf := [8]byte{}
+	binary.LittleEndian.PutUint64(buf[:], serial)
+
+	err = fsWriteFileAtomic(path, buf[:], 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store serial: %w", err)
+	}
+
+	return new(big.Int).SetUint64(serial), nil
+}
+
+func caserialsHighest(datadir string) (uint64, error) {
+	records, err := cadbLoad(datadir)
+	if err != nil {
+		return 0, err
+	}
+
+	highest := uint64(1)
+	for _, record := range records {
+		serial, isNumber := new(big.Int).SetString(record.Serial, 10)
+		if isNumber && serial.IsUint64() && serial.Uint64() > highest {
+			highest = serial.Uint64()
+		}
+	}
+
+	return highest, nil
+}
+
+func (r caserialsRandom) next() (*big.Int, error) {
+	records, err := cadbLoad(r.datadir)
+	if err != nil {
+		return nil, err
+	}
+
+	used := map[string]bool{}
+	for _, record := range records {
+		used[record.Serial] = true
+	}
+
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	for attempt := 0; attempt < 8; attempt++ {
+		serial, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		if serial.Sign() > 0 && !used[serial.String()] {
+			return serial, nil
+		}
+	}
+
+	return nil, fmt.Errorf("failed to find an unused serial")
+}
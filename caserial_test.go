@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCaserialsCounter(t *testing.T) {
+	datadir, err := ioutil.TempDir("", "caserial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(datadir)
+
+	serials := caserialsCounter{datadir: datadir}
+
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				serial, err := serials.next()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if seen[serial.String()] {
+					t.Errorf("Serial %s was handed out twice", serial)
+				}
+				seen[serial.String()] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != 100 || !seen["2"] || !seen["101"] {
+		t.Errorf("Expected serials 2 to 101, got %d serials", len(seen))
+	}
+
+	// A truncated counter continues from the records
+	err = ioutil.WriteFile(filepath.Join(datadir, "serial"), []byte{}, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cadbSave(datadir, []cadbRecord{{Serial: "101"}, {Serial: "7"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := serials.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial.String() != "102" {
+		t.Errorf("Expected serial 102 after the records, got %s", serial)
+	}
+}
+
+func TestCaserialsRandom(t *testing.T) {
+	datadir, err := ioutil.TempDir("", "caserial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(datadir)
+
+	serials, err := caserialsFromConfig(caconfig{Datadir: datadir, Serials: "random"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := serials.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial.Sign() <= 0 || serial.BitLen() > 128 {
+		t.Errorf("Expected a positive 128-bit serial, got %s", serial)
+	}
+
+	_, err = caserialsFromConfig(caconfig{Datadir: datadir, Serials: "sequential"})
+	if err == nil {
+		t.Error("Expected an unknown serial allocation to be refused")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// The key which signs certificates and CRLs. It is read from sign-key
+// as PKCS#1, PKCS#8 or SEC1, or it stays in a PKCS#11 token when
+// sign-pkcs11 is configured. A key file may be encrypted as a PKCS#8
+// PBES2 key, with the passphrase from sign-key-passphrase.
+
+var (
+	casignerOidPbes2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	casignerOidPbkdf2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	casignerOidHmacSha1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	casignerOidHmacSha256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+)
+
+var casignerAesCbc = map[string]int{
+	asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}.String():  16,
+	asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}.String(): 24,
+	asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}.String(): 32,
+}
+
+type casignerEncryptedKey struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Data      []byte
+}
+
+type casignerPbes2Params struct {
+	KeyDerivation pkix.AlgorithmIdentifier
+	Encryption    pkix.AlgorithmIdentifier
+}
+
+type casignerPbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	Prf        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+func caLoadSigncert(config caconfig) (*x509.Certificate, crypto.Signer, error) {
+	signcertPem, err := ioutil.ReadFile(config.Signcert)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, rest := pem.Decode(signcertPem)
+	if block == nil || len(rest) > 0 {
+		return nil, nil, fmt.Errorf("trailing garbage in %s", config.Signcert)
+	}
+
+	signcert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var signkey crypto.Signer
+	if config.SignPkcs11 != nil {
+		signkey, err = casignerPkcs11(*config.SignPkcs11)
+	} else {
+		signkey, err = casignerLoadFile(config.Signkey, config.SignkeyPassphrase)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !certKeyEqual(signcert.PublicKey, signkey.Public()) {
+		return nil, nil, fmt.Errorf("signing key does not match %s", config.Signcert)
+	}
+
+	return signcert, signkey, nil
+}
+
+func casignerLoadFile(path string, passphrase *kekconfig) (crypto.Signer, error) {
+	keyPem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, rest := pem.Decode(keyPem)
+	if block == nil || len(rest) > 0 {
+		return nil, fmt.Errorf("trailing garbage in %s", path)
+	}
+
+	// The legacy PEM encryption is unauthenticated and uses a weak
+	// key derivation
+	if block.Headers["Proc-Type"] == "4,ENCRYPTED" {
+		return nil, fmt.Errorf(
+			"%s uses the legacy PEM encryption, convert it with openssl pkcs8 -topk8 -v2 aes256",
+			path,
+		)
+	}
+
+	der := block.Bytes
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		if passphrase == nil {
+			return nil, fmt.Errorf("%s is encrypted, but sign-key-passphrase is not set", path)
+		}
+
+		secret, err := kekSecret(*passphrase, "passphrase")
+		if err != nil {
+			return nil, err
+		}
+
+		der, err = casignerDecrypt(block, secret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w", path, err)
+		}
+	}
+
+	signkey, err := keyParse(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return signkey, nil
+}
+
+// Decrypts a PKCS#8 key encrypted with PBES2, using PBKDF2 and AES-CBC
+func casignerDecrypt(block *pem.Block, passphrase []byte) ([]byte, error) {
+	var encrypted casignerEncryptedKey
+	_, err := asn1.Unmarshal(block.Bytes, &encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	if !encrypted.Algorithm.Algorithm.Equal(casignerOidPbes2) {
+		return nil, fmt.Errorf("unsupported encryption %s, expected PBES2", encrypted.Algorithm.Algorithm)
+	}
+
+	var params casignerPbes2Params
+	_, err = asn1.Unmarshal(encrypted.Algorithm.Parameters.FullBytes, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	if !params.KeyDerivation.Algorithm.Equal(casignerOidPbkdf2) {
+		return nil, fmt.Errorf("unsupported key derivation %s, expected PBKDF2", params.KeyDerivation.Algorithm)
+	}
+
+	var kdf casignerPbkdf2Params
+	_, err = asn1.Unmarshal(params.KeyDerivation.Parameters.FullBytes, &kdf)
+	if err != nil {
+		return nil, err
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case len(kdf.Prf.Algorithm) == 0, kdf.Prf.Algorithm.Equal(casignerOidHmacSha1):
+		prf = sha1.New
+	case kdf.Prf.Algorithm.Equal(casignerOidHmacSha256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 function %s", kdf.Prf.Algorithm)
+	}
+
+	keyLength, found := casignerAesCbc[params.Encryption.Algorithm.String()]
+	if !found {
+		return nil, fmt.Errorf("unsupported cipher %s, expected AES-CBC", params.Encryption.Algorithm)
+	}
+
+	var iv []byte
+	_, err = asn1.Unmarshal(params.Encryption.Parameters.FullBytes, &iv)
+	if err != nil {
+		return nil, err
+	}
+
+	key := pbkdf2.Key(passphrase, kdf.Salt, kdf.Iterations, keyLength, prf)
+	aesBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data := encrypted.Data
+	if len(iv) != aesBlock.BlockSize() || len(data) == 0 || len(data)%aesBlock.BlockSize() != 0 {
+		return nil, fmt.Errorf("malformed encrypted key")
+	}
+
+	der := make([]byte, len(data))
+	cipher.NewCBCDecrypter(aesBlock, iv).CryptBlocks(der, data)
+
+	// A wrong passphrase usually shows as bad padding
+	padding := int(der[len(der)-1])
+	if padding == 0 || padding > aesBlock.BlockSize() {
+		return nil, fmt.Errorf("incorrect passphrase")
+	}
+	for _, b := range der[len(der)-padding:] {
+		if int(b) != padding {
+			return nil, fmt.Errorf("incorrect passphrase")
+		}
+	}
+
+	return der[:len(der)-padding], nil
+}
@@ -0,0 +1,25 @@
+//go:build pkcs11
+// +build pkcs11
+
+package main
+
+import (
+	"crypto"
+)
+
+func casignerPkcs11(conf pkcs11config) (crypto.Signer, error) {
+	session, err := pkcs11SessionOpen(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	keylabel := conf.KeyLabel
+	if len(keylabel) == 0 {
+		keylabel = "joonos-ca"
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	return session.signerByLabel(keylabel)
+}
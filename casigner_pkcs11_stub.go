@@ -0,0 +1,13 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package main
+
+import (
+	"crypto"
+	"fmt"
+)
+
+func casignerPkcs11(conf pkcs11config) (crypto.Signer, error) {
+	return nil, fmt.Errorf("built without PKCS#11 support, rebuild with -tags pkcs11")
+}
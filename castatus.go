@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Health of the CA, published retained on joonos-ca/status. The
+// broker publishes "offline" as the last will if the CA disappears.
+type castatus struct {
+	State    string     `json:"state"`
+	Instance string     `json:"instance"`
+	Since    time.Time  `json:"since"`
+	Metrics  *cametrics `json:"metrics,omitempty"`
+
+	// Recorded by subscribers, so that a rewritten audit log can be
+	// told apart from the one which the CA had
+	AuditHead *caauditHead `json:"audit-head,omitempty"`
+}
+
+// What became of the CSRs since the CA started
+type cametrics struct {
+	Received    uint64 `json:"received"`
+	Issued      uint64 `json:"issued"`
+	Pending     uint64 `json:"pending"`
+	Rejected    uint64 `json:"rejected"`
+	RateLimited uint64 `json:"rate-limited"`
+	Failed      uint64 `json:"failed"`
+}
+
+// Keeps the state and the metrics of the CA, which are reported from
+// the CA loop and from the MQTT client
+type careporter struct {
+	mu       sync.Mutex
+	instance string
+	datadir  string
+	state    string
+	since    time.Time
+	metrics  cametrics
+}
+
+func careporterNew(instance string, datadir string) *careporter {
+	return &careporter{
+		instance: instance,
+		datadir:  datadir,
+		state:    "starting",
+		since:    time.Now().UTC(),
+	}
+}
+
+// Counts a CSR by the outcome of caIssue
+func (r *careporter) count(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics.Received++
+
+	switch err.(type) {
+	case nil:
+		r.metrics.Issued++
+	case capendingError:
+		r.metrics.Pending++
+	case capolicyError:
+		r.metrics.Rejected++
+	case calimitError:
+		r.metrics.RateLimited++
+	default:
+		r.metrics.Failed++
+	}
+}
+
+// The last will, which the broker publishes as is
+func (r *careporter) will() []byte {
+	payload, _ := json.Marshal(castatus{
+		State:    "offline",
+		Instance: r.instance,
+		Since:    time.Now().UTC(),
+	})
+	return payload
+}
+
+// Changes to state, and returns the status to publish
+func (r *careporter) enter(state string) []byte {
+	r.mu.Lock()
+	if r.state != state {
+		r.state = state
+		r.since = time.Now().UTC()
+	}
+	r.mu.Unlock()
+
+	return r.payload()
+}
+
+func (r *careporter) payload() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	metrics := r.metrics
+	status := castatus{
+		State:    r.state,
+		Instance: r.instance,
+		Since:    r.since,
+		Metrics:  &metrics,
+	}
+
+	head, err := caauditLoadHead(r.datadir)
+	if err == nil && head.Seq > 0 {
+		status.AuditHead = &head
+	}
+
+	payload, _ := json.Marshal(status)
+	return payload
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"flag"
 	"fmt"
@@ -12,7 +18,7 @@ import (
 	"time"
 )
 
-func certCheckKeyMatch(cert *x509.Certificate, key interface{}) error {
+func certCheckKeyMatch(cert *x509.Certificate, key crypto.Signer) error {
 	if key == nil {
 		return fmt.Errorf("key is not set")
 	}
@@ -21,18 +27,8 @@ func certCheckKeyMatch(cert *x509.Certificate, key interface{}) error {
 		return fmt.Errorf("main cert is not set")
 	}
 
-	rsakey, isRsakey := key.(*rsa.PrivateKey)
-	if !isRsakey {
-		return fmt.Errorf("check is only implemented for RSA keys")
-	}
-
-	switch pub := cert.PublicKey.(type) {
-	case *rsa.PublicKey:
-		if pub.N.Cmp(rsakey.N) != 0 {
-			return fmt.Errorf("private key does not match")
-		}
-	default:
-		return fmt.Errorf("expected cert with an RSA key")
+	if !certKeyEqual(cert.PublicKey, key.Public()) {
+		return fmt.Errorf("private key does not match")
 	}
 
 	return nil
@@ -67,6 +63,24 @@ func certDecodePem(pemBytes []byte) ([]*x509.Certificate, error) {
 	return res, nil
 }
 
+func csrDecodePem(pemBytes []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+
+	if block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("expected a certificate request, got %s", block.Type)
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate request: %w", err)
+	}
+
+	return csr, nil
+}
+
 func certDesc(cert *x509.Certificate) string {
 	return fmt.Sprintf(
 		"%s, issued by %s%s",
@@ -96,18 +110,22 @@ func certDescValidityPeriod(cert *x509.Certificate) string {
 	)
 }
 
+func certKeyFingerprint(spki []byte) string {
+	sum := sha256.Sum256(spki)
+	return hex.EncodeToString(sum[:])
+}
+
 func certKeyEqual(keya crypto.PublicKey, keyb crypto.PublicKey) bool {
-	rsakeya, isRsakey := keya.(*rsa.PublicKey)
-
-	if isRsakey {
-		rsakeyb, isRsakey := keyb.(*rsa.PublicKey)
-		if isRsakey {
-			sameN := rsakeya.N.Cmp(rsakeyb.N) == 0
-			sameE := rsakeya.E == rsakeyb.E
-			return sameN && sameE
-		} else {
-			return false
-		}
+	switch a := keya.(type) {
+	case *rsa.PublicKey:
+		b, isRsakey := keyb.(*rsa.PublicKey)
+		return isRsakey && a.N.Cmp(b.N) == 0 && a.E == b.E
+	case *ecdsa.PublicKey:
+		b, isEckey := keyb.(*ecdsa.PublicKey)
+		return isEckey && a.Curve == b.Curve && a.X.Cmp(b.X) == 0 && a.Y.Cmp(b.Y) == 0
+	case ed25519.PublicKey:
+		b, isEdkey := keyb.(ed25519.PublicKey)
+		return isEdkey && bytes.Equal(a, b)
 	}
 
 	return false
@@ -145,27 +163,80 @@ func certShow(cert *x509.Certificate) {
 	fmt.Println("Certificate of", certDesc(cert))
 }
 
-func certShowFromPath(path string, cacertPath string) error {
-	cacert, err := certLoadOneFromPath(cacertPath)
-	if err != nil {
-		return fmt.Errorf("failed to load CA cert from %s: %w", cacertPath, err)
-	}
+type certShowOutput struct {
+	Certificates []certinfo        `json:"certificates"`
+	Verified     bool              `json:"verified"`
+	Lint         []certlintFinding `json:"lint,omitempty"`
+}
 
+func certShowFromPath(
+	path string,
+	cacertPath string,
+	format string,
+	lint bool,
+	maxLifetime time.Duration,
+) error {
 	certificates, err := certLoadFromPath(path)
 	if err != nil {
 		return fmt.Errorf("failed to load certs from %s: %w", path, err)
 	}
 
-	chain, err := certVerifyChain(certificates, cacert)
-	if err != nil {
-		return fmt.Errorf("failed to verify certs from %s, %s: %w", path, cacertPath, err)
+	if len(certificates) == 0 {
+		return fmt.Errorf("no certificates in %s", path)
 	}
 
-	for _, cert := range chain {
-		certShow(cert)
+	output := certShowOutput{}
+
+	// The verified chain is shown, while the lint looks at the file
+	// as given, so that problems with its order are reported
+	shown := certificates
+	if len(cacertPath) > 0 {
+		cacert, err := certLoadOneFromPath(cacertPath)
+		if err != nil {
+			return fmt.Errorf("failed to load CA cert from %s: %w", cacertPath, err)
+		}
+
+		shown, err = certVerifyChain(certificates, cacert)
+		if err != nil {
+			return fmt.Errorf("failed to verify certs from %s, %s: %w", path, cacertPath, err)
+		}
+
+		output.Verified = true
 	}
 
-	return nil
+	for _, cert := range shown {
+		output.Certificates = append(output.Certificates, certinfoGet(cert))
+	}
+
+	if lint {
+		output.Lint = certLint(certificates, maxLifetime)
+	}
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "    ")
+		return encoder.Encode(&output)
+	case "text":
+		for _, info := range output.Certificates {
+			certinfoWriteText(os.Stdout, info)
+		}
+
+		if output.Verified {
+			fmt.Println("Chain verified against", cacertPath)
+		}
+
+		if lint {
+			fmt.Printf("Lint findings: %d\n", len(output.Lint))
+			for _, finding := range output.Lint {
+				fmt.Printf("  [%d] %s\n", finding.Certificate, finding.Message)
+			}
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unknown format %s", format)
 }
 
 func certShowRaw(certificates [][]byte) error {
@@ -184,13 +255,17 @@ func certShowSubcommand() *subcommand {
 	flagset := flag.NewFlagSet("cert-show", flag.ExitOnError)
 
 	certIn := flagset.String("in", "", "path to PEM file")
-	cacertIn := flagset.String("cacert", "", "path to PEM file")
+	cacertIn := flagset.String("cacert", "", "path to PEM file of a CA to verify the chain with")
+	format := flagset.String("format", "text", "output format, text or json")
+	lint := flagset.Bool("lint", false, "check the certificates for common problems")
+	maxDays := flagset.Int("lint-max-days", 398, "longest acceptable lifetime for leaf certificates")
 
 	run := func() error {
 		if len(*certIn) == 0 {
 			return fmt.Errorf("the -in parameter is required")
 		}
-		return certShowFromPath(*certIn, *cacertIn)
+		maxLifetime := time.Duration(*maxDays) * 24 * time.Hour
+		return certShowFromPath(*certIn, *cacertIn, *format, *lint, maxLifetime)
 	}
 
 	certShowCommand := subcommand{
@@ -207,13 +282,16 @@ func certVerifyChain(
 	leaf := certs[0]
 	intermediates := certs[1:]
 
-	return certVerifyLeafIntermediatesCa(leaf, intermediates, cacert)
+	// Any certificate of the PKI may be shown, such as the one of
+	// the broker
+	return certVerifyLeafIntermediatesCa(leaf, intermediates, cacert, x509.ExtKeyUsageAny)
 }
 
 func certVerifyLeafIntermediatesCa(
 	leaf *x509.Certificate,
 	intermediates []*x509.Certificate,
-	cacert *x509.Certificate) ([]*x509.Certificate, error) {
+	cacert *x509.Certificate,
+	usage x509.ExtKeyUsage) ([]*x509.Certificate, error) {
 
 	caPool := x509.NewCertPool()
 	caPool.AddCert(cacert)
@@ -226,6 +304,7 @@ func certVerifyLeafIntermediatesCa(
 	opts := x509.VerifyOptions{
 		Intermediates: intermediatePool,
 		Roots:         caPool,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
 	}
 
 	chains, err := leaf.Verify(opts)
@@ -285,31 +364,29 @@ func certWriteChain(dest string, certs []*x509.Certificate) error {
 	return nil
 }
 
-func certWriteKey(dest string, key interface{}) error {
+// Writes key as PKCS#8 PEM, readable only by the owner. With kek,
+// the key is encrypted with it.
+func certWriteKey(dest string, key crypto.Signer, kek []byte) error {
 	keybytes, err := x509.MarshalPKCS8PrivateKey(key)
 	if err != nil {
 		return fmt.Errorf("failed to marshal key: %w", err)
 	}
 
-	keyblock := pem.Block{
+	keyblock := &pem.Block{
 		Type:  "PRIVATE KEY",
 		Bytes: keybytes,
 	}
 
-	keyfile, err := os.Create(dest)
-	if err != nil {
-		return fmt.Errorf(
-			"failed to create %s: %w",
-			dest,
-			err,
-		)
+	if kek != nil {
+		keyblock, err = keycryptEncrypt(keybytes, kek)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt key: %w", err)
+		}
 	}
 
-	defer keyfile.Close()
-
-	err = pem.Encode(keyfile, &keyblock)
+	err = fsWriteFileAtomic(dest, pem.EncodeToMemory(keyblock), 0600)
 	if err != nil {
-		return fmt.Errorf("failed to encode key to %s: %w", dest, err)
+		return fmt.Errorf("failed to write key to %s: %w", dest, err)
 	}
 
 	return nil
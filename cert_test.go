@@ -1,8 +1,15 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"io/ioutil"
+	"math/big"
 	"testing"
+	"time"
 )
 
 func Test_certDecodePem(t *testing.T) {
@@ -21,3 +28,59 @@ func Test_certDecodePem(t *testing.T) {
 		t.Errorf("Expected non-nil cert")
 	}
 }
+
+func TestCertCheckKeyMatchEcdsa(t *testing.T) {
+	cert, key := catestSigner(t)
+
+	err := certCheckKeyMatch(cert, key)
+	if err != nil {
+		t.Errorf("Expected the ECDSA key to match: %v", err)
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = certCheckKeyMatch(cert, other)
+	if err == nil {
+		t.Error("Expected another ECDSA key not to match")
+	}
+}
+
+func TestCertVerifyUsages(t *testing.T) {
+	cacert, cakey := catestSigner(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Like the broker certificate from ca init
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "broker"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, cacert, key.Public(), cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = certVerifyChain([]*x509.Certificate{leaf}, cacert)
+	if err != nil {
+		t.Errorf("Expected a server certificate to verify for cert-show: %v", err)
+	}
+
+	_, err = certVerifyLeafIntermediatesCa(leaf, nil, cacert, x509.ExtKeyUsageClientAuth)
+	if err == nil {
+		t.Error("Expected a server certificate not to verify as a node certificate")
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Detailed, machine-readable description of a certificate, for
+// cert-show
+
+type certinfoExtension struct {
+	Oid      string `json:"oid"`
+	Name     string `json:"name,omitempty"`
+	Critical bool   `json:"critical"`
+}
+
+type certinfo struct {
+	Subject            string              `json:"subject"`
+	Issuer             string              `json:"issuer"`
+	Serial             string              `json:"serial"`
+	NotBefore          time.Time           `json:"not-before"`
+	NotAfter           time.Time           `json:"not-after"`
+	Validity           string              `json:"validity"`
+	KeyType            string              `json:"key-type"`
+	KeySize            int                 `json:"key-size"`
+	SignatureAlgorithm string              `json:"signature-algorithm"`
+	IsCA               bool                `json:"is-ca"`
+	KeyUsage           []string            `json:"key-usage"`
+	ExtKeyUsage        []string            `json:"ext-key-usage"`
+	DnsNames           []string            `json:"dns-names,omitempty"`
+	IpAddresses        []string            `json:"ip-addresses,omitempty"`
+	Uris               []string            `json:"uris,omitempty"`
+	Emails             []string            `json:"emails,omitempty"`
+	SubjectKeyId       string              `json:"subject-key-id,omitempty"`
+	AuthorityKeyId     string              `json:"authority-key-id,omitempty"`
+	Extensions         []certinfoExtension `json:"extensions"`
+	Sha256             string              `json:"sha256-fingerprint"`
+	Sha1               string              `json:"sha1-fingerprint"`
+	SpkiSha256         string              `json:"spki-sha256"`
+}
+
+var certinfoKeyUsages = []struct {
+	usage x509.KeyUsage
+	name  string
+}{
+	{x509.KeyUsageDigitalSignature, "digitalSignature"},
+	{x509.KeyUsageContentCommitment, "contentCommitment"},
+	{x509.KeyUsageKeyEncipherment, "keyEncipherment"},
+	{x509.KeyUsageDataEncipherment, "dataEncipherment"},
+	{x509.KeyUsageKeyAgreement, "keyAgreement"},
+	{x509.KeyUsageCertSign, "keyCertSign"},
+	{x509.KeyUsageCRLSign, "cRLSign"},
+	{x509.KeyUsageEncipherOnly, "encipherOnly"},
+	{x509.KeyUsageDecipherOnly, "decipherOnly"},
+}
+
+var certinfoExtKeyUsages = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "any",
+	x509.ExtKeyUsageServerAuth:      "serverAuth",
+	x509.ExtKeyUsageClientAuth:      "clientAuth",
+	x509.ExtKeyUsageCodeSigning:     "codeSigning",
+	x509.ExtKeyUsageEmailProtection: "emailProtection",
+	x509.ExtKeyUsageTimeStamping:    "timeStamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSPSigning",
+}
+
+var certinfoExtensionNames = map[string]string{
+	"2.5.29.14":         "subjectKeyIdentifier",
+	"2.5.29.15":         "keyUsage",
+	"2.5.29.17":         "subjectAltName",
+	"2.5.29.19":         "basicConstraints",
+	"2.5.29.30":         "nameConstraints",
+	"2.5.29.31":         "cRLDistributionPoints",
+	"2.5.29.32":         "certificatePolicies",
+	"2.5.29.35":         "authorityKeyIdentifier",
+	"2.5.29.37":         "extKeyUsage",
+	"1.3.6.1.5.5.7.1.1": "authorityInfoAccess",
+}
+
+func certKeyDesc(pub interface{}) (string, int) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return "RSA", k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return "ECDSA", k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return "Ed25519", 256
+	}
+
+	return fmt.Sprintf("%T", pub), 0
+}
+
+func certinfoOidName(oid asn1.ObjectIdentifier) string {
+	return certinfoExtensionNames[oid.String()]
+}
+
+func certinfoGet(cert *x509.Certificate) certinfo {
+	keyType, keySize := certKeyDesc(cert.PublicKey)
+
+	keyUsage := []string{}
+	for _, ku := range certinfoKeyUsages {
+		if cert.KeyUsage&ku.usage != 0 {
+			keyUsage = append(keyUsage, ku.name)
+		}
+	}
+
+	extKeyUsage := []string{}
+	for _, eku := range cert.ExtKeyUsage {
+		name, found := certinfoExtKeyUsages[eku]
+		if !found {
+			name = fmt.Sprintf("%d", eku)
+		}
+		extKeyUsage = append(extKeyUsage, name)
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		extKeyUsage = append(extKeyUsage, oid.String())
+	}
+
+	ipAddresses := []string{}
+	for _, ip := range cert.IPAddresses {
+		ipAddresses = append(ipAddresses, ip.String())
+	}
+
+	uris := []string{}
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+
+	extensions := []certinfoExtension{}
+	for _, ext := range cert.Extensions {
+		extensions = append(extensions, certinfoExtension{
+			Oid:      ext.Id.String(),
+			Name:     certinfoOidName(ext.Id),
+			Critical: ext.Critical,
+		})
+	}
+
+	sha256sum := sha256.Sum256(cert.Raw)
+	sha1sum := sha1.Sum(cert.Raw)
+
+	return certinfo{
+		Subject:            cert.Subject.String(),
+		Issuer:             cert.Issuer.String(),
+		Serial:             cert.SerialNumber.String(),
+		NotBefore:          cert.NotBefore,
+		NotAfter:           cert.NotAfter,
+		Validity:           strings.TrimSpace(certDescValidityPeriod(cert)),
+		KeyType:            keyType,
+		KeySize:            keySize,
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		IsCA:               cert.IsCA,
+		KeyUsage:           keyUsage,
+		ExtKeyUsage:        extKeyUsage,
+		DnsNames:           cert.DNSNames,
+		IpAddresses:        ipAddresses,
+		Uris:               uris,
+		Emails:             cert.EmailAddresses,
+		SubjectKeyId:       hex.EncodeToString(cert.SubjectKeyId),
+		AuthorityKeyId:     hex.EncodeToString(cert.AuthorityKeyId),
+		Extensions:         extensions,
+		Sha256:             hex.EncodeToString(sha256sum[:]),
+		Sha1:               hex.EncodeToString(sha1sum[:]),
+		SpkiSha256:         certKeyFingerprint(cert.RawSubjectPublicKeyInfo),
+	}
+}
+
+func certinfoWriteText(w io.Writer, info certinfo) {
+	fmt.Fprintf(w, "Certificate %s\n", info.Subject)
+	fmt.Fprintf(w, "  Issuer:        %s\n", info.Issuer)
+	fmt.Fprintf(w, "  Serial:        %s\n", info.Serial)
+	fmt.Fprintf(w, "  Not before:    %s\n", info.NotBefore)
+	fmt.Fprintf(w, "  Not after:     %s\n", info.NotAfter)
+	fmt.Fprintf(w, "  Validity:      %s\n", info.Validity)
+	fmt.Fprintf(w, "  Key:           %s %d\n", info.KeyType, info.KeySize)
+	fmt.Fprintf(w, "  Signature:     %s\n", info.SignatureAlgorithm)
+	fmt.Fprintf(w, "  CA:            %v\n", info.IsCA)
+	fmt.Fprintf(w, "  Key usage:     %s\n", strings.Join(info.KeyUsage, ", "))
+	fmt.Fprintf(w, "  Ext key usage: %s\n", strings.Join(info.ExtKeyUsage, ", "))
+
+	sans := [][2]string{
+		{"DNS", strings.Join(info.DnsNames, ", ")},
+		{"IP", strings.Join(info.IpAddresses, ", ")},
+		{"URI", strings.Join(info.Uris, ", ")},
+		{"Email", strings.Join(info.Emails, ", ")},
+	}
+	for _, san := range sans {
+		if len(san[1]) > 0 {
+			fmt.Fprintf(w, "  SAN %-10s %s\n", san[0]+":", san[1])
+		}
+	}
+
+	if len(info.SubjectKeyId) > 0 {
+		fmt.Fprintf(w, "  Subject key:   %s\n", info.SubjectKeyId)
+	}
+	if len(info.AuthorityKeyId) > 0 {
+		fmt.Fprintf(w, "  Authority key: %s\n", info.AuthorityKeyId)
+	}
+
+	fmt.Fprintln(w, "  Extensions:")
+	for _, ext := range info.Extensions {
+		critical := ""
+		if ext.Critical {
+			critical = " (critical)"
+		}
+		fmt.Fprintf(w, "    %s %s%s\n", ext.Oid, ext.Name, critical)
+	}
+
+	fmt.Fprintf(w, "  SHA-256:       %s\n", info.Sha256)
+	fmt.Fprintf(w, "  SHA-1:         %s\n", info.Sha1)
+	fmt.Fprintf(w, "  SPKI SHA-256:  %s\n", info.SpkiSha256)
+}
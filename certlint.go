@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+type certlintFinding struct {
+	Certificate int    `json:"certificate"`
+	Message     string `json:"message"`
+}
+
+var certlintWeakSignatures = map[x509.SignatureAlgorithm]bool{
+	x509.MD2WithRSA:    true,
+	x509.MD5WithRSA:    true,
+	x509.SHA1WithRSA:   true,
+	x509.DSAWithSHA1:   true,
+	x509.ECDSAWithSHA1: true,
+}
+
+// Checks a chain of certificates, leaf first, for common problems.
+// Leaf certificates living longer than maxLifetime are flagged.
+func certLint(chain []*x509.Certificate, maxLifetime time.Duration) []certlintFinding {
+	findings := []certlintFinding{}
+
+	add := func(n int, format string, args ...interface{}) {
+		findings = append(findings, certlintFinding{
+			Certificate: n,
+			Message:     fmt.Sprintf(format, args...),
+		})
+	}
+
+	for n, cert := range chain {
+		keyType, keySize := certKeyDesc(cert.PublicKey)
+		switch {
+		case keyType == "RSA" && keySize < 2048:
+			add(n, "weak RSA key of %d bits", keySize)
+		case keyType == "ECDSA" && keySize < 256:
+			add(n, "weak ECDSA key of %d bits", keySize)
+		}
+
+		if certlintWeakSignatures[cert.SignatureAlgorithm] {
+			add(n, "weak signature algorithm %s", cert.SignatureAlgorithm)
+		}
+
+		if cert.KeyUsage == 0 {
+			add(n, "missing KeyUsage")
+		}
+
+		lifetime := cert.NotAfter.Sub(cert.NotBefore)
+
+		if cert.IsCA {
+			if !cert.BasicConstraintsValid {
+				add(n, "CA without basic constraints")
+			}
+			if cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+				add(n, "CA without keyCertSign in KeyUsage")
+			}
+		} else {
+			if len(cert.ExtKeyUsage) == 0 && len(cert.UnknownExtKeyUsage) == 0 {
+				add(n, "missing ExtKeyUsage")
+			}
+			if maxLifetime > 0 && lifetime > maxLifetime {
+				add(n, "lifetime of %d days exceeds %d days",
+					int(lifetime.Hours())/24,
+					int(maxLifetime.Hours())/24)
+			}
+		}
+
+		if n > 0 && !cert.IsCA {
+			add(n, "certificate in issuer position is not a CA")
+		}
+
+		if n+1 < len(chain) {
+			issuer := chain[n+1]
+			if !bytes.Equal(cert.RawIssuer, issuer.RawSubject) {
+				add(n, "next certificate in chain is not its issuer (%s)", issuer.Subject)
+			} else if err := cert.CheckSignatureFrom(issuer); err != nil {
+				add(n, "signature does not verify with next certificate: %v", err)
+			}
+		}
+	}
+
+	return findings
+}
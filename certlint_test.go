@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+)
+
+func TestCertLintChainOrder(t *testing.T) {
+	certs, err := certLoadFromPath("test-files/unprovisioned.cert.pem")
+	if err != nil {
+		t.Fatalf("Failed to load certificates: %v", err)
+	}
+
+	for _, finding := range certLint(certs, 0) {
+		if strings.Contains(finding.Message, "issuer") {
+			t.Errorf("Unexpected finding for a chain in order: %s", finding.Message)
+		}
+	}
+
+	reversed := []*x509.Certificate{certs[1], certs[0]}
+	found := false
+	for _, finding := range certLint(reversed, 0) {
+		if finding.Certificate == 0 && strings.Contains(finding.Message, "not its issuer") {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Error("Expected a finding about chain order")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// Extensions of the certificates which the CA issues. Key usages are
+// named as in cert-show. Sans is "filter" (the default) to only take
+// the SANs from the CSR which match the patterns, "copy" to take every
+// DNS name and URI, or "none". IP addresses and email addresses are
+// only ever taken when they match their patterns. Patterns are Go
+// templates expanded with .CommonName and then matched as in
+// path.Match. Without a sans setting, URIs default to the node URN.
+type certprofile struct {
+	KeyUsage       []string `json:"key-usage"`
+	ExtKeyUsage    []string `json:"ext-key-usage"`
+	Sans           string   `json:"sans"`
+	DnsNames       []string `json:"dns-names"`
+	Uris           []string `json:"uris"`
+	IpAddresses    []string `json:"ip-addresses"`
+	EmailAddresses []string `json:"email-addresses"`
+	CrlUrls        []string `json:"crl-urls"`
+	OcspUrls       []string `json:"ocsp-urls"`
+	IssuerUrls     []string `json:"issuer-urls"`
+}
+
+var certprofileDefaultUris = []string{"urn:joonos:node:{{.CommonName}}"}
+
+// Escapes the characters which are special to path.Match, so that a
+// common name can not widen a pattern
+var certprofileGlobEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	"*", "\\*",
+	"?", "\\?",
+	"[", "\\[",
+)
+
+func certprofileKeyUsage(names []string) (x509.KeyUsage, error) {
+	var usage x509.KeyUsage
+
+	for _, name := range names {
+		found := false
+		for _, ku := range certinfoKeyUsages {
+			if ku.name == name {
+				usage |= ku.usage
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown key usage %s", name)
+		}
+	}
+
+	return usage, nil
+}
+
+func certprofileExtKeyUsage(names []string) ([]x509.ExtKeyUsage, error) {
+	usages := []x509.ExtKeyUsage{}
+
+	for _, name := range names {
+		found := false
+		for eku, ekuName := range certinfoExtKeyUsages {
+			if ekuName == name {
+				usages = append(usages, eku)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown extended key usage %s", name)
+		}
+	}
+
+	return usages, nil
+}
+
+func certprofileExpand(pattern string, commonName string) (string, error) {
+	tmpl, err := template.New("san").Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return "", err
+	}
+
+	buf := bytes.Buffer{}
+	err = tmpl.Execute(&buf, struct{ CommonName string }{certprofileGlobEscaper.Replace(commonName)})
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+func certprofileMatch(patterns []string, value string, commonName string) (bool, error) {
+	for _, pattern := range patterns {
+		expanded, err := certprofileExpand(pattern, commonName)
+		if err != nil {
+			return false, err
+		}
+
+		matched, err := path.Match(expanded, value)
+		if err != nil {
+			return false, fmt.Errorf("bad pattern %s: %w", pattern, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// SHA-1 of the subjectPublicKey bits, as in RFC 5280 4.2.1.2
+func certprofileKeyId(spki []byte) ([]byte, error) {
+	var info struct {
+		Algorithm asn1.RawValue
+		PublicKey asn1.BitString
+	}
+
+	_, err := asn1.Unmarshal(spki, &info)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum(info.PublicKey.Bytes)
+	return sum[:], nil
+}
+
+func (p certprofile) check() error {
+	_, err := certprofileKeyUsage(p.KeyUsage)
+	if err != nil {
+		return err
+	}
+
+	_, err = certprofileExtKeyUsage(p.ExtKeyUsage)
+	if err != nil {
+		return err
+	}
+
+	switch p.Sans {
+	case "", "copy", "filter", "none":
+	default:
+		return fmt.Errorf("unknown SAN policy %s", p.Sans)
+	}
+
+	patterns := append(append([]string{}, p.DnsNames...), p.Uris...)
+	patterns = append(append(patterns, p.IpAddresses...), p.EmailAddresses...)
+	for _, pattern := range patterns {
+		_, err = certprofileMatch([]string{pattern}, "", "")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Fills in the extensions of template for a certificate issued for csr
+func (p certprofile) apply(template *x509.Certificate, csr *x509.CertificateRequest) error {
+	keyUsage, err := certprofileKeyUsage(p.KeyUsage)
+	if err != nil {
+		return err
+	}
+	if len(p.KeyUsage) == 0 {
+		keyUsage = x509.KeyUsageDigitalSignature
+		if _, isRsa := csr.PublicKey.(*rsa.PublicKey); isRsa {
+			keyUsage |= x509.KeyUsageKeyEncipherment
+		}
+	}
+
+	extKeyUsage, err := certprofileExtKeyUsage(p.ExtKeyUsage)
+	if err != nil {
+		return err
+	}
+	if len(p.ExtKeyUsage) == 0 {
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+
+	keyId, err := certprofileKeyId(csr.RawSubjectPublicKeyInfo)
+	if err != nil {
+		return fmt.Errorf("failed to compute key identifier: %w", err)
+	}
+
+	template.KeyUsage = keyUsage
+	template.ExtKeyUsage = extKeyUsage
+	template.BasicConstraintsValid = true
+	template.IsCA = false
+	template.SubjectKeyId = keyId
+	template.CRLDistributionPoints = p.CrlUrls
+	template.OCSPServer = p.OcspUrls
+	template.IssuingCertificateURL = p.IssuerUrls
+
+	commonName := csr.Subject.CommonName
+
+	uriPatterns := p.Uris
+	if len(p.Sans) == 0 && p.Uris == nil {
+		uriPatterns = certprofileDefaultUris
+	}
+
+	dnsNames := []string{}
+	uris := []*url.URL{}
+	switch p.Sans {
+	case "", "filter":
+		for _, name := range csr.DNSNames {
+			matched, err := certprofileMatch(p.DnsNames, name, commonName)
+			if err != nil {
+				return err
+			}
+			if matched {
+				dnsNames = append(dnsNames, name)
+			}
+		}
+
+		for _, uri := range csr.URIs {
+			matched, err := certprofileMatch(uriPatterns, uri.String(), commonName)
+			if err != nil {
+				return err
+			}
+			if matched {
+				uris = append(uris, uri)
+			}
+		}
+	case "copy":
+		dnsNames = csr.DNSNames
+		uris = csr.URIs
+	case "none":
+		return nil
+	default:
+		return fmt.Errorf("unknown SAN policy %s", p.Sans)
+	}
+
+	ipAddresses := []net.IP{}
+	for _, ip := range csr.IPAddresses {
+		matched, err := certprofileMatch(p.IpAddresses, ip.String(), commonName)
+		if err != nil {
+			return err
+		}
+		if matched {
+			ipAddresses = append(ipAddresses, ip)
+		}
+	}
+
+	emailAddresses := []string{}
+	for _, address := range csr.EmailAddresses {
+		matched, err := certprofileMatch(p.EmailAddresses, address, commonName)
+		if err != nil {
+			return err
+		}
+		if matched {
+			emailAddresses = append(emailAddresses, address)
+		}
+	}
+
+	template.DNSNames = dnsNames
+	template.URIs = uris
+	template.IPAddresses = ipAddresses
+	template.EmailAddresses = emailAddresses
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestCertprofileFilter(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	own, _ := url.Parse("urn:joonos:node:node1")
+	other, _ := url.Parse("urn:joonos:node:node2")
+	csrb, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "node1"},
+		DNSNames: []string{"node1.nodes.example.com", "www.example.com"},
+		URIs:     []*url.URL{own, other},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile := certprofile{
+		Sans:     "filter",
+		DnsNames: []string{"{{.CommonName}}.nodes.example.com"},
+		Uris:     []string{"urn:joonos:node:{{.CommonName}}"},
+	}
+	err = profile.check()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{}
+	err = profile.apply(template, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(template.DNSNames) != 1 || template.DNSNames[0] != "node1.nodes.example.com" {
+		t.Errorf("Expected only the own DNS name, got %v", template.DNSNames)
+	}
+	if len(template.URIs) != 1 || template.URIs[0].String() != own.String() {
+		t.Errorf("Expected only the own URI, got %v", template.URIs)
+	}
+
+	if template.KeyUsage != x509.KeyUsageDigitalSignature {
+		t.Errorf("Expected digitalSignature for an ECDSA key, got %v", template.KeyUsage)
+	}
+	if len(template.ExtKeyUsage) != 1 || template.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Errorf("Expected clientAuth, got %v", template.ExtKeyUsage)
+	}
+	if len(template.SubjectKeyId) != 20 {
+		t.Errorf("Expected a SHA-1 key identifier, got %x", template.SubjectKeyId)
+	}
+}
+
+func TestCertprofileDefaultSans(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	own, _ := url.Parse("urn:joonos:node:node*")
+	other, _ := url.Parse("urn:joonos:node:node2")
+	csrb, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:        pkix.Name{CommonName: "node*"},
+		DNSNames:       []string{"mqtt.example.com"},
+		URIs:           []*url.URL{own, other},
+		IPAddresses:    []net.IP{net.ParseIP("192.0.2.10")},
+		EmailAddresses: []string{"admin@example.com"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{}
+	err = certprofile{}.apply(template, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(template.DNSNames) != 0 || len(template.IPAddresses) != 0 || len(template.EmailAddresses) != 0 {
+		t.Errorf("Expected no DNS names, IPs or emails by default, got %v", template)
+	}
+	if len(template.URIs) != 1 || template.URIs[0].String() != own.String() {
+		t.Errorf("Expected only the own URI, got %v", template.URIs)
+	}
+
+	template = &x509.Certificate{}
+	err = certprofile{Sans: "copy", IpAddresses: []string{"192.0.2.*"}}.apply(template, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(template.DNSNames) != 1 || len(template.URIs) != 2 {
+		t.Errorf("Expected copy to keep DNS names and URIs, got %v, %v", template.DNSNames, template.URIs)
+	}
+	if len(template.IPAddresses) != 1 || len(template.EmailAddresses) != 0 {
+		t.Errorf("Expected only the listed IPs, got %v, %v", template.IPAddresses, template.EmailAddresses)
+	}
+}
+
+func TestCertprofileCheck(t *testing.T) {
+	bad := []certprofile{
+		{KeyUsage: []string{"signEverything"}},
+		{ExtKeyUsage: []string{"clientAuthz"}},
+		{Sans: "all"},
+		{Sans: "filter", DnsNames: []string{"[bad"}},
+	}
+
+	for _, profile := range bad {
+		if profile.check() == nil {
+			t.Errorf("Expected %+v to be rejected", profile)
+		}
+	}
+}
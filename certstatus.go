@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const certstatusDefaultAlarmFraction = 0.95
+
+// Health of the node certificate, as published on
+// joonos/<node>/status/cert
+type certstatus struct {
+	State       string     `json:"state"`
+	Serial      string     `json:"serial,omitempty"`
+	Subject     string     `json:"subject,omitempty"`
+	Issuer      string     `json:"issuer,omitempty"`
+	NotBefore   *time.Time `json:"not-before,omitempty"`
+	NotAfter    *time.Time `json:"not-after,omitempty"`
+	RenewalDue  *time.Time `json:"renewal-due,omitempty"`
+	AlarmAfter  *time.Time `json:"alarm-after,omitempty"`
+	LastAttempt *time.Time `json:"last-renewal-attempt,omitempty"`
+	LastResult  string     `json:"last-renewal-result,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// Outcome of the latest renewal of the node certificate
+type certrenewal struct {
+	attempt *time.Time
+	result  string
+}
+
+func (r *certrenewal) started() {
+	now := time.Now()
+	r.attempt = &now
+	r.result = "pending"
+}
+
+func (r *certrenewal) failed(err error) {
+	r.result = fmt.Sprintf("failed: %v", err)
+}
+
+func (r *certrenewal) waiting(err error) {
+	r.result = fmt.Sprintf("waiting: %v", err)
+}
+
+func (r *certrenewal) succeeded() {
+	r.result = "ok"
+}
+
+func certstatusGet(s state, renewal certrenewal, alarmFraction float64) certstatus {
+	status := certstatus{
+		LastAttempt: renewal.attempt,
+		LastResult:  renewal.result,
+	}
+
+	if s.nodecert == nil || s.nodecert.Leaf == nil {
+		status.State = "absent"
+		if s.nodecerterr != nil {
+			status.Error = s.nodecerterr.Error()
+		}
+		return status
+	}
+
+	leaf := s.nodecert.Leaf
+	notBefore := leaf.NotBefore
+	notAfter := leaf.NotAfter
+	renewalDue := s.now().Add(s.certRenewTime())
+
+	if alarmFraction <= 0 || alarmFraction > 1 {
+		alarmFraction = certstatusDefaultAlarmFraction
+	}
+	lifetime := notAfter.Sub(notBefore)
+	alarmAfter := notBefore.Add(time.Duration(alarmFraction * float64(lifetime)))
+
+	status.Serial = leaf.SerialNumber.String()
+	status.Subject = leaf.Subject.String()
+	status.Issuer = leaf.Issuer.String()
+	status.NotBefore = &notBefore
+	status.NotAfter = &notAfter
+	status.RenewalDue = &renewalDue
+	status.AlarmAfter = &alarmAfter
+
+	now := s.now()
+	switch {
+	case s.nodecerterr != nil:
+		status.State = "invalid"
+		status.Error = s.nodecerterr.Error()
+	case now.After(notAfter):
+		status.State = "expired"
+	case now.After(alarmAfter):
+		status.State = "alarm"
+	case !now.Before(renewalDue):
+		status.State = "renewing"
+	default:
+		status.State = "ok"
+	}
+
+	return status
+}
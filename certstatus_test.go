@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func certstatusTestState(notBefore time.Time, notAfter time.Time) state {
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+
+	return state{
+		nodecert: &tls.Certificate{Leaf: leaf},
+	}
+}
+
+func TestCertstatusStates(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+
+	cases := []struct {
+		notBefore time.Time
+		notAfter  time.Time
+		expected  string
+	}{
+		{now.Add(-day), now.Add(99 * day), "ok"},
+		{now.Add(-90 * day), now.Add(10 * day), "renewing"},
+		{now.Add(-97 * day), now.Add(3 * day), "alarm"},
+		{now.Add(-100 * day), now.Add(-day), "expired"},
+	}
+
+	for _, c := range cases {
+		status := certstatusGet(certstatusTestState(c.notBefore, c.notAfter), certrenewal{}, 0)
+		if status.State != c.expected {
+			t.Errorf("Expected %s, got %s", c.expected, status.State)
+		}
+
+		if status.Serial != "42" {
+			t.Errorf("Expected serial 42, got %s", status.Serial)
+		}
+	}
+
+	status := certstatusGet(state{}, certrenewal{}, 0)
+	if status.State != "absent" {
+		t.Errorf("Expected absent, got %s", status.State)
+	}
+}
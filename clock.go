@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Boards without an RTC start at 1970, which makes every certificate
+// look not yet valid. The clock is considered implausible if it is
+// earlier than the build time of the program or the NotBefore of any
+// certificate the node has, and then a time estimate is taken from
+// the Date header of an HTTPS server.
+
+// Can be set at build time with -ldflags "-X main.clockBuildTime=..."
+// in RFC 3339 format. Otherwise the VCS commit time is used, if
+// available, which needs Go 1.18 to build.
+var clockBuildTime string = ""
+
+type clockconfig struct {
+	Server   string `json:"server"`
+	SetClock bool   `json:"set-system-clock"`
+}
+
+func clockBuilt() time.Time {
+	if len(clockBuildTime) > 0 {
+		built, err := time.Parse(time.RFC3339, clockBuildTime)
+		if err == nil {
+			return built
+		}
+	}
+
+	return clockVcsTime()
+}
+
+// The earliest time which the clock can plausibly show
+func clockLowerBound(certs []*x509.Certificate) time.Time {
+	bound := clockBuilt()
+
+	for _, cert := range certs {
+		if cert.NotBefore.After(bound) {
+			bound = cert.NotBefore
+		}
+	}
+
+	return bound
+}
+
+func (s state) certificates() []*x509.Certificate {
+	certs := []*x509.Certificate{s.cacert}
+
+	for _, tlscert := range []*tls.Certificate{&s.provcert, s.nodecert} {
+		if tlscert == nil {
+			continue
+		}
+		for _, raw := range tlscert.Certificate {
+			cert, err := x509.ParseCertificate(raw)
+			if err == nil {
+				certs = append(certs, cert)
+			}
+		}
+	}
+
+	return certs
+}
+
+// Gets the time from the Date header of server. The clock can not
+// be trusted for validating the certificate of the server during the
+// handshake, so the chain is instead verified afterwards, at the time
+// which the server claims.
+func clockHttpsDate(server string, rootCAs *x509.CertPool, policy tlspolicy) (time.Time, error) {
+	tlsconf := &tls.Config{
+		InsecureSkipVerify: true,
+	}
+
+	err := policy.apply(tlsconf, policy.Clock)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsconf,
+		},
+		Timeout: 30 * time.Second,
+	}
+
+	res, err := client.Head(server)
+	if err != nil {
+		return time.Time{}, err
+	}
+	res.Body.Close()
+
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad Date from %s: %w", server, err)
+	}
+
+	if res.TLS == nil || len(res.TLS.PeerCertificates) == 0 {
+		return time.Time{}, fmt.Errorf("expected %s to use TLS", server)
+	}
+
+	peerCerts := res.TLS.PeerCertificates
+	intermediates := x509.NewCertPool()
+	for _, cert := range peerCerts[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	serverName := tlsconf.ServerName
+	if len(serverName) == 0 {
+		serverName = res.Request.URL.Hostname()
+	}
+
+	_, err = peerCerts[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Intermediates: intermediates,
+		Roots:         rootCAs,
+		CurrentTime:   date,
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to verify %s at %s: %w", server, date, err)
+	}
+
+	return date, nil
+}
+
+func clockSet(t time.Time) error {
+	tv := unix.NsecToTimeval(t.UnixNano())
+	return unix.Settimeofday(&tv)
+}
+
+// Checks the clock and, if it is implausible, asks the configured
+// server for the time until it gets an answer or runs out of
+// attempts. Returns the offset between the system clock and the
+// trusted time, which is zero if the system clock was set.
+func clockBootstrap(conf clockconfig, s state) (time.Duration, error) {
+	bound := clockLowerBound(s.certificates())
+	now := time.Now()
+
+	if !now.Before(bound) {
+		return 0, nil
+	}
+
+	fmt.Printf("Clock shows %s, which is before %s\n", now, bound)
+
+	if len(conf.Server) == 0 {
+		return 0, fmt.Errorf("clock is implausible and no time server is configured")
+	}
+
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+	rootCAs.AddCert(s.cacert)
+
+	wait := 5 * time.Second
+	for attempt := 0; attempt < 8; attempt++ {
+		date, err := clockHttpsDate(conf.Server, rootCAs, s.config.Tls)
+		if err != nil {
+			fmt.Printf("Failed to get time from %s: %v\n", conf.Server, err)
+			time.Sleep(wait)
+			wait *= 2
+			continue
+		}
+
+		if date.Before(bound) {
+			return 0, fmt.Errorf("%s claims time %s, which is before %s", conf.Server, date, bound)
+		}
+
+		skew := date.Sub(time.Now())
+		fmt.Printf("Clock is behind by %s according to %s\n", skew, conf.Server)
+
+		if conf.SetClock {
+			err = clockSet(time.Now().Add(skew))
+			if err != nil {
+				return skew, fmt.Errorf("failed to set clock: %w", err)
+			}
+			fmt.Println("Set the system clock to", time.Now())
+			return 0, nil
+		}
+
+		return skew, nil
+	}
+
+	return 0, fmt.Errorf("could not get the time from %s", conf.Server)
+}
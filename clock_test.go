@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClockLowerBound(t *testing.T) {
+	later := time.Now().Add(24 * time.Hour)
+	certs := []*x509.Certificate{
+		{NotBefore: time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{NotBefore: later},
+	}
+
+	bound := clockLowerBound(certs)
+	if !bound.Equal(later) {
+		t.Errorf("Expected %s, got %s", later, bound)
+	}
+}
+
+func TestClockHttpsDate(t *testing.T) {
+	date := time.Now().UTC().Truncate(time.Second)
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Date", date.Format(http.TimeFormat))
+		},
+	))
+	defer server.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+
+	got, err := clockHttpsDate(server.URL, rootCAs, tlspolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(date) {
+		t.Errorf("Expected %s, got %s", date, got)
+	}
+
+	_, err = clockHttpsDate(server.URL, x509.NewCertPool(), tlspolicy{})
+	if err == nil {
+		t.Error("Expected an untrusted server to be rejected")
+	}
+}
@@ -0,0 +1,28 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"runtime/debug"
+	"time"
+)
+
+// The commit time embedded by the Go toolchain
+func clockVcsTime() time.Time {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return time.Time{}
+	}
+
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.time" {
+			built, err := time.Parse(time.RFC3339, setting.Value)
+			if err == nil {
+				return built
+			}
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,11 @@
+//go:build !go1.18
+// +build !go1.18
+
+package main
+
+import "time"
+
+// Older toolchains do not embed the VCS information
+func clockVcsTime() time.Time {
+	return time.Time{}
+}
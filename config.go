@@ -13,6 +13,30 @@ type config struct {
 	Mqttsrv  string   `json:"mqtt-server"`
 	Nodename string   `json:"node-name"`
 	Upgrade  []string `json:"upgrade"`
+	Tags     []string `json:"tags"`
+
+	Csr csrconfig `json:"csr"`
+
+	Enrollment enrollconfig `json:"enrollment"`
+
+	// Fraction of the certificate lifetime after which failing
+	// renewals are reported as an alarm
+	CertAlarmFraction float64 `json:"cert-alarm-fraction"`
+
+	Renewal renewconfig `json:"renewal"`
+
+	// Applies to the MQTT connection and the HTTPS clients
+	Tls tlspolicy `json:"tls"`
+
+	// Where to get the time from when the clock is implausible
+	Clock clockconfig `json:"clock"`
+
+	// When set, the node key is kept in a PKCS#11 token
+	// instead of data-directory
+	Pkcs11 *pkcs11config `json:"pkcs11"`
+
+	// When set, the node key in data-directory is encrypted
+	KeyEncryption *kekconfig `json:"key-encryption"`
 }
 
 func configLoad(path string) (config, error) {
@@ -38,3 +62,7 @@ func (c config) Nodecert() string {
 func (c config) Nodekey() string {
 	return c.Datadir + "/node.key.pem"
 }
+
+func (c config) NodekeyPending() string {
+	return c.Datadir + "/node.key.pending.pem"
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// Templates for the contents of the CSRs produced by the node. Each
+// value is a text/template which is expanded with csrvalues. List
+// values are split on newlines, and empty results are left out, so
+// e.g. "{{lines .Tags}}" turns into one entry per tag.
+type csrconfig struct {
+	CommonName         string   `json:"common-name"`
+	SerialNumber       string   `json:"serial-number"`
+	Organization       []string `json:"organization"`
+	OrganizationalUnit []string `json:"organizational-unit"`
+	DnsNames           []string `json:"dns-names"`
+	Uris               []string `json:"uris"`
+}
+
+type csrvalues struct {
+	Nodename  string
+	Hostname  string
+	MachineId string
+	Serial    string
+	Tags      []string
+}
+
+var csrSerialPaths = []string{
+	"/sys/class/dmi/id/product_serial",
+	"/sys/firmware/devicetree/base/serial-number",
+	"/proc/device-tree/serial-number",
+}
+
+var csrTemplateFuncs = template.FuncMap{
+	"lines": func(ss []string) string {
+		return strings.Join(ss, "\n")
+	},
+}
+
+func csrReadValue(path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	// Device tree strings come with a terminating nul
+	return strings.TrimSpace(sysdescStringFromBytesSlice(content))
+}
+
+func csrValuesLoad(nodename string, tags []string) csrvalues {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = ""
+	}
+
+	serial := ""
+	for _, path := range csrSerialPaths {
+		serial = csrReadValue(path)
+		if len(serial) > 0 {
+			break
+		}
+	}
+
+	return csrvalues{
+		Nodename:  nodename,
+		Hostname:  hostname,
+		MachineId: csrReadValue("/etc/machine-id"),
+		Serial:    serial,
+		Tags:      tags,
+	}
+}
+
+func csrExpand(tmpl string, values csrvalues) (string, error) {
+	t, err := template.New("csr").Funcs(csrTemplateFuncs).Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template %q: %w", tmpl, err)
+	}
+
+	buf := bytes.Buffer{}
+	err = t.Execute(&buf, values)
+	if err != nil {
+		return "", fmt.Errorf("failed to expand template %q: %w", tmpl, err)
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
+
+func csrExpandList(tmpls []string, values csrvalues) ([]string, error) {
+	res := []string{}
+
+	for _, tmpl := range tmpls {
+		expanded, err := csrExpand(tmpl, values)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range strings.Split(expanded, "\n") {
+			line = strings.TrimSpace(line)
+			if len(line) > 0 {
+				res = append(res, line)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func csrTemplate(conf csrconfig, values csrvalues) (*x509.CertificateRequest, error) {
+	cnTemplate := conf.CommonName
+	if len(cnTemplate) == 0 {
+		cnTemplate = "{{.Nodename}}"
+	}
+
+	commonName, err := csrExpand(cnTemplate, values)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(commonName) == 0 {
+		return nil, fmt.Errorf("common name expands to an empty string")
+	}
+
+	serialNumber, err := csrExpand(conf.SerialNumber, values)
+	if err != nil {
+		return nil, err
+	}
+
+	organization, err := csrExpandList(conf.Organization, values)
+	if err != nil {
+		return nil, err
+	}
+
+	organizationalUnit, err := csrExpandList(conf.OrganizationalUnit, values)
+	if err != nil {
+		return nil, err
+	}
+
+	dnsNames, err := csrExpandList(conf.DnsNames, values)
+	if err != nil {
+		return nil, err
+	}
+
+	uriStrings, err := csrExpandList(conf.Uris, values)
+	if err != nil {
+		return nil, err
+	}
+
+	uris := make([]*url.URL, 0, len(uriStrings))
+	for _, uriString := range uriStrings {
+		uri, err := url.Parse(uriString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse URI %s: %w", uriString, err)
+		}
+		uris = append(uris, uri)
+	}
+
+	subject := pkix.Name{
+		CommonName:         commonName,
+		SerialNumber:       serialNumber,
+		Organization:       organization,
+		OrganizationalUnit: organizationalUnit,
+	}
+
+	return &x509.CertificateRequest{
+		Subject:  subject,
+		DNSNames: dnsNames,
+		URIs:     uris,
+	}, nil
+}
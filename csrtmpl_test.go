@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCsrTemplate(t *testing.T) {
+	values := csrvalues{
+		Nodename:  "node1",
+		Hostname:  "host1",
+		MachineId: "0123abcd",
+		Serial:    "SN42",
+		Tags:      []string{"lab", "", "edge"},
+	}
+	conf := csrconfig{
+		SerialNumber:       "{{.Serial}}",
+		OrganizationalUnit: []string{"{{lines .Tags}}"},
+		DnsNames:           []string{"{{.Hostname}}.example.com"},
+		Uris:               []string{"urn:joonos:node:{{.Nodename}}"},
+	}
+
+	csr, err := csrTemplate(conf, values)
+	if err != nil {
+		t.Fatalf("Failed to expand templates: %v", err)
+	}
+
+	if csr.Subject.CommonName != "node1" {
+		t.Errorf("Expected CN node1, got %s", csr.Subject.CommonName)
+	}
+
+	if csr.Subject.SerialNumber != "SN42" {
+		t.Errorf("Expected serial SN42, got %s", csr.Subject.SerialNumber)
+	}
+
+	ous := csr.Subject.OrganizationalUnit
+	if len(ous) != 2 || ous[0] != "lab" || ous[1] != "edge" {
+		t.Errorf("Expected OUs [lab edge], got %v", ous)
+	}
+
+	if len(csr.DNSNames) != 1 || csr.DNSNames[0] != "host1.example.com" {
+		t.Errorf("Unexpected DNS names %v", csr.DNSNames)
+	}
+
+	if len(csr.URIs) != 1 || csr.URIs[0].String() != "urn:joonos:node:node1" {
+		t.Errorf("Unexpected URIs %v", csr.URIs)
+	}
+}
+
+func TestCsrTemplateBad(t *testing.T) {
+	values := csrvalues{Nodename: "node1"}
+
+	_, err := csrTemplate(csrconfig{CommonName: "{{.Nope}}"}, values)
+	if err == nil {
+		t.Error("Expected to fail with an unknown field")
+	}
+
+	_, err = csrTemplate(csrconfig{CommonName: "{{.Serial}}"}, values)
+	if err == nil {
+		t.Error("Expected to fail with an empty common name")
+	}
+}
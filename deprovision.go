@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Request for the CA to revoke the node certificate, published on
+// joonos/<node>/revoke when deprovisioning
+type revokeRequest struct {
+	Serial string `json:"serial"`
+	Reason string `json:"reason"`
+}
+
+// Clears the retained topics of the node and optionally asks the CA
+// to revoke the certificate. Connects with the node certificate, so
+// this has to happen before the local state is removed.
+func deprovisionMqtt(s state, revoke bool) error {
+	tlsconf := s.tlsconfig()
+	mqttName := tlsconf.Certificates[0].Leaf.Subject.CommonName
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(s.config.Mqttsrv)
+	opts.SetTLSConfig(tlsconf)
+	opts.SetUsername(mqttName)
+	opts.SetAutoReconnect(false)
+
+	client := mqtt.NewClient(opts)
+	connectToken := client.Connect()
+	if !connectToken.WaitTimeout(30 * time.Second) {
+		return fmt.Errorf("timed out connecting to %s", s.config.Mqttsrv)
+	}
+	if err := connectToken.Error(); err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer client.Disconnect(1000)
+
+	publish := func(topic string, payload []byte, retained bool) error {
+		token := client.Publish(topic, 1, retained, payload)
+		token.Wait()
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("failed to publish on %s: %w", topic, err)
+		}
+		return nil
+	}
+
+	if revoke {
+		payload, err := json.Marshal(revokeRequest{
+			Serial: s.nodecert.Leaf.SerialNumber.String(),
+			Reason: "cessationOfOperation",
+		})
+		if err != nil {
+			return err
+		}
+
+		topic := fmt.Sprintf("joonos/%s/revoke", mqttName)
+		err = publish(topic, payload, false)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Requested revocation of serial", s.nodecert.Leaf.SerialNumber)
+	}
+
+	for _, suffix := range []string{"status/description", "status/stat", "status/cert", "csr"} {
+		topic := fmt.Sprintf("joonos/%s/%s", mqttName, suffix)
+		err := publish(topic, []byte{}, true)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Cleared", topic)
+	}
+
+	return nil
+}
+
+// Moves the node certificate and key into a timestamped directory
+// under data-directory/archive
+func deprovisionArchive(s state) (string, error) {
+	dir := filepath.Join(
+		s.config.Datadir,
+		"archive",
+		time.Now().UTC().Format("20060102T150405Z"),
+	)
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return dir, err
+	}
+
+	certpath := s.config.Nodecert()
+	err = os.Rename(certpath, filepath.Join(dir, filepath.Base(certpath)))
+	if err != nil && !os.IsNotExist(err) {
+		return dir, err
+	}
+
+	err = s.keys.archive(dir)
+	if err != nil {
+		return dir, fmt.Errorf("failed to archive node key: %w", err)
+	}
+
+	return dir, nil
+}
+
+func deprovision(configpath string, revoke bool, offline bool) error {
+	config, err := configLoad(configpath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	state, err := stateLoad(config)
+	if err != nil {
+		return fmt.Errorf("failed to initialize state: %w", err)
+	}
+
+	usable := state.nodecert != nil && state.nodecerterr == nil
+	if revoke && !usable {
+		return fmt.Errorf("can not request revocation without a usable node certificate: %v", state.nodecerterr)
+	}
+
+	if !offline {
+		if !usable {
+			return fmt.Errorf(
+				"can not clear topics without a usable node certificate, use -offline: %v",
+				state.nodecerterr,
+			)
+		}
+
+		err = deprovisionMqtt(state, revoke)
+		if err != nil {
+			return fmt.Errorf("failed to clean up on the broker, use -offline to skip: %w", err)
+		}
+	}
+
+	dir, err := deprovisionArchive(state)
+	if err != nil {
+		return fmt.Errorf("failed to archive node identity: %w", err)
+	}
+
+	fmt.Println("Archived node certificate and key in", dir)
+
+	return nil
+}
+
+func deprovisionSubcommand() *subcommand {
+	flagset := flag.NewFlagSet("deprovision", flag.ExitOnError)
+	args := commonArgs{}
+	commonFlags(flagset, &args)
+
+	revoke := flagset.Bool("revoke", false, "ask the CA to revoke the node certificate")
+	offline := flagset.Bool("offline", false, "only remove the local state, without contacting the broker")
+
+	run := func() error {
+		if *revoke && *offline {
+			return fmt.Errorf("-revoke needs the broker, it can not be used with -offline")
+		}
+		return deprovision(args.config, *revoke, *offline)
+	}
+
+	deprovisionCommand := subcommand{
+		flagset: flagset,
+		run:     run,
+	}
+	return &deprovisionCommand
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+// enroller gets certificates issued for the CSRs of the node. The
+// certificates arrive asynchronously through certs(), leaf first, and
+// failures that the enroller learns about arrive through failures().
+type enroller interface {
+	enroll(csr *x509.CertificateRequest, tlsconf *tls.Config, renewal bool)
+	clear()
+	certs() <-chan []*x509.Certificate
+	failures() <-chan error
+}
+
+// The CA holds the CSR until an operator approves it. The node keeps
+// the CSR and its key, and sends the same CSR again later.
+type enrollPendingError struct {
+	reason string
+}
+
+func (e enrollPendingError) Error() string {
+	return fmt.Sprintf("CSR is waiting for approval: %s", e.reason)
+}
+
+type enrollconfig struct {
+	Method    string `json:"method"`
+	EstServer string `json:"est-server"`
+
+	// File with a one-time token which is included in the
+	// first CSR of the node
+	TokenFile string `json:"token-file"`
+}
+
+// The original enrollment mechanism, where the CSR is published as a
+// retained message on joonos/<node>/csr and the CA replies on
+// joonos/<node>/cert, or on joonos/<node>/csr/rejected or
+// joonos/<node>/csr/pending
+type enrollerMqtt struct {
+	mqtt mqttservice
+}
+
+func enrollerFromConfig(conf enrollconfig, mqttchans mqttservice) (enroller, error) {
+	switch conf.Method {
+	case "", "mqtt":
+		return enrollerMqtt{mqtt: mqttchans}, nil
+	case "est":
+		if len(conf.EstServer) == 0 {
+			return nil, fmt.Errorf("EST enrollment requires est-server")
+		}
+		return enrollerEstNew(conf.EstServer), nil
+	}
+
+	return nil, fmt.Errorf("unknown enrollment method %s", conf.Method)
+}
+
+func (e enrollerMqtt) enroll(csr *x509.CertificateRequest, _ *tls.Config, _ bool) {
+	e.mqtt.csrs <- csr
+}
+
+func (e enrollerMqtt) clear() {
+	e.mqtt.csrs <- nil
+}
+
+func (e enrollerMqtt) certs() <-chan []*x509.Certificate {
+	return e.mqtt.certs
+}
+
+func (e enrollerMqtt) failures() <-chan error {
+	return e.mqtt.rejections
+}
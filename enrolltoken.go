@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// One-time enrollment tokens. A node which is provisioned for the
+// first time proves that it has its factory-generated token with the
+// challengePassword attribute of the CSR, and the CA only accepts the
+// CSR if the token is registered for the requested name and has not
+// been consumed by some other key. The token itself is not sent, as
+// other holders of the provisioning certificate can read the CSR.
+
+var oidChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+
+type enrolltokenEntry struct {
+	Name        string     `json:"name"`
+	TokenSha256 string     `json:"token-sha256"`
+	Consumed    *time.Time `json:"consumed,omitempty"`
+	KeySha256   string     `json:"key-sha256,omitempty"`
+}
+
+type enrolltokenRegistry struct {
+	Tokens []enrolltokenEntry `json:"tokens"`
+}
+
+type csrRaw struct {
+	Info      asn1.RawValue
+	SigAlg    pkix.AlgorithmIdentifier
+	Signature asn1.BitString
+}
+
+type csrRawInfo struct {
+	Version    int
+	Subject    asn1.RawValue
+	PublicKey  asn1.RawValue
+	Attributes asn1.RawValue
+}
+
+type csrRawAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+var csrSignatureHashes = map[x509.SignatureAlgorithm]crypto.Hash{
+	x509.SHA256WithRSA:   crypto.SHA256,
+	x509.SHA384WithRSA:   crypto.SHA384,
+	x509.SHA512WithRSA:   crypto.SHA512,
+	x509.ECDSAWithSHA256: crypto.SHA256,
+	x509.ECDSAWithSHA384: crypto.SHA384,
+	x509.ECDSAWithSHA512: crypto.SHA512,
+}
+
+func enrolltokenLoad(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(content))
+	if len(token) == 0 {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+
+	return token, nil
+}
+
+func enrolltokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// The proof of a token for a key is an HMAC-SHA256 of the
+// SubjectPublicKeyInfo keyed with the SHA-256 of the token, which the
+// CA has in its registry. It is of no use with any other key.
+func enrolltokenProof(tokenSha256 string, spki []byte) (string, error) {
+	key, err := hex.DecodeString(tokenSha256)
+	if err != nil {
+		return "", fmt.Errorf("bad token hash: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(spki)
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Go does not support producing a challengePassword attribute, so it
+// is appended to the attributes of an already created CSR, which is
+// then signed again.
+func csrAddChallengePassword(
+	csr *x509.CertificateRequest,
+	password string,
+	key crypto.Signer,
+) (*x509.CertificateRequest, error) {
+	hash, found := csrSignatureHashes[csr.SignatureAlgorithm]
+	if !found {
+		return nil, fmt.Errorf("unsupported CSR signature algorithm %v", csr.SignatureAlgorithm)
+	}
+
+	var raw csrRaw
+	_, err := asn1.Unmarshal(csr.Raw, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSR: %w", err)
+	}
+
+	var info csrRawInfo
+	_, err = asn1.Unmarshal(csr.RawTBSCertificateRequest, &info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CSR info: %w", err)
+	}
+
+	value, err := asn1.MarshalWithParams(password, "utf8")
+	if err != nil {
+		return nil, err
+	}
+
+	attribute, err := asn1.Marshal(csrRawAttribute{
+		Type: oidChallengePassword,
+		Values: asn1.RawValue{
+			Class:      asn1.ClassUniversal,
+			Tag:        asn1.TagSet,
+			IsCompound: true,
+			Bytes:      value,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The old attributes alias the original CSR, so they are
+	// copied before appending
+	attributes := append([]byte{}, info.Attributes.Bytes...)
+	info.Attributes.Bytes = append(attributes, attribute...)
+	info.Attributes.FullBytes = nil
+
+	infoBytes, err := asn1.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hash.New()
+	h.Write(infoBytes)
+
+	signature, err := key.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign CSR: %w", err)
+	}
+
+	csrBytes, err := asn1.Marshal(csrRaw{
+		Info:   asn1.RawValue{FullBytes: infoBytes},
+		SigAlg: raw.SigAlg,
+		Signature: asn1.BitString{
+			Bytes:     signature,
+			BitLength: 8 * len(signature),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificateRequest(csrBytes)
+}
+
+func csrChallengePassword(csr *x509.CertificateRequest) (string, bool, error) {
+	var info csrRawInfo
+	_, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &info)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to parse CSR info: %w", err)
+	}
+
+	attributes := info.Attributes.Bytes
+	for len(attributes) > 0 {
+		var attribute csrRawAttribute
+		attributes, err = asn1.Unmarshal(attributes, &attribute)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to parse CSR attribute: %w", err)
+		}
+
+		if !attribute.Type.Equal(oidChallengePassword) {
+			continue
+		}
+
+		var password string
+		_, err = asn1.Unmarshal(attribute.Values.Bytes, &password)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to parse challengePassword: %w", err)
+		}
+
+		return password, true, nil
+	}
+
+	return "", false, nil
+}
+
+func enrolltokenRegistryLoad(path string) (enrolltokenRegistry, error) {
+	var registry enrolltokenRegistry
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return registry, err
+	}
+
+	err = json.Unmarshal(content, &registry)
+	if err != nil {
+		return registry, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return registry, nil
+}
+
+func enrolltokenRegistrySave(path string, registry enrolltokenRegistry) error {
+	content, err := json.MarshalIndent(registry, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return fsWriteFileAtomic(path, content, 0600)
+}
+
+// Checks the token proof of csr against the registry at path, and
+// marks the token consumed by the key of the CSR. A token may be
+// proven again with the same key, as happens when a CSR is repeated.
+func enrolltokenConsume(path string, csr *x509.CertificateRequest) error {
+	proof, found, err := csrChallengePassword(csr)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return fmt.Errorf("CSR has no enrollment token")
+	}
+
+	registry, err := enrolltokenRegistryLoad(path)
+	if err != nil {
+		return fmt.Errorf("failed to load enrollment tokens: %w", err)
+	}
+
+	name := csr.Subject.CommonName
+	keyHash := certKeyFingerprint(csr.RawSubjectPublicKeyInfo)
+
+	for n := range registry.Tokens {
+		entry := &registry.Tokens[n]
+
+		if entry.Name != name {
+			continue
+		}
+
+		expected, err := enrolltokenProof(entry.TokenSha256, csr.RawSubjectPublicKeyInfo)
+		if err != nil {
+			return fmt.Errorf("enrollment token of %s: %w", name, err)
+		}
+
+		if !hmac.Equal([]byte(proof), []byte(expected)) {
+			continue
+		}
+
+		if entry.Consumed != nil {
+			if entry.KeySha256 == keyHash {
+				return nil
+			}
+			return fmt.Errorf("enrollment token for %s was consumed on %s", name, entry.Consumed)
+		}
+
+		now := time.Now()
+		entry.Consumed = &now
+		entry.KeySha256 = keyHash
+
+		return enrolltokenRegistrySave(path, registry)
+	}
+
+	return fmt.Errorf("no enrollment token of %s matches the CSR", name)
+}
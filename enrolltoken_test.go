@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const enrolltokenTestToken = "s3cret"
+
+// A CSR with password as its challengePassword, or a proof of
+// enrolltokenTestToken if it is empty
+func enrolltokenTestCsrWith(t *testing.T, name string, password string) *x509.CertificateRequest {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	template := x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: name},
+	}
+
+	csrb, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
+	if err != nil {
+		t.Fatalf("Failed to create CSR: %v", err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrb)
+	if err != nil {
+		t.Fatalf("Failed to parse CSR: %v", err)
+	}
+
+	if len(password) == 0 {
+		password, err = enrolltokenProof(enrolltokenHash(enrolltokenTestToken), csr.RawSubjectPublicKeyInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	csr, err = csrAddChallengePassword(csr, password, key)
+	if err != nil {
+		t.Fatalf("Failed to add token: %v", err)
+	}
+
+	err = csr.CheckSignature()
+	if err != nil {
+		t.Fatalf("Bad signature after adding token: %v", err)
+	}
+
+	return csr
+}
+
+// A CSR with a proof of enrolltokenTestToken
+func enrolltokenTestCsr(t *testing.T, name string) *x509.CertificateRequest {
+	return enrolltokenTestCsrWith(t, name, "")
+}
+
+func TestCsrChallengePassword(t *testing.T) {
+	csr := enrolltokenTestCsrWith(t, "node1", "s3cret")
+
+	password, found, err := csrChallengePassword(csr)
+	if err != nil {
+		t.Fatalf("Failed to read token: %v", err)
+	}
+
+	if !found || password != "s3cret" {
+		t.Errorf("Expected to find s3cret, got %v %s", found, password)
+	}
+}
+
+func TestEnrolltokenConsume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrolltoken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tokens.json")
+	registry := enrolltokenRegistry{
+		Tokens: []enrolltokenEntry{
+			{Name: "node1", TokenSha256: enrolltokenHash("s3cret")},
+		},
+	}
+	err = enrolltokenRegistrySave(path, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enrolltokenConsume(path, enrolltokenTestCsr(t, "node2"))
+	if err == nil {
+		t.Error("Expected the token to be rejected for another name")
+	}
+
+	err = enrolltokenConsume(path, enrolltokenTestCsrWith(t, "node1", enrolltokenTestToken))
+	if err == nil {
+		t.Error("Expected the plain token to be rejected")
+	}
+
+	// Another holder of the provisioning certificate can read the
+	// proof, but it does not match another key
+	proof, _, err := csrChallengePassword(enrolltokenTestCsr(t, "node1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = enrolltokenConsume(path, enrolltokenTestCsrWith(t, "node1", proof))
+	if err == nil {
+		t.Error("Expected a copied proof to be rejected")
+	}
+
+	csr := enrolltokenTestCsr(t, "node1")
+	err = enrolltokenConsume(path, csr)
+	if err != nil {
+		t.Fatalf("Expected the token to be accepted: %v", err)
+	}
+
+	err = enrolltokenConsume(path, csr)
+	if err != nil {
+		t.Errorf("Expected the token to be accepted again for the same key: %v", err)
+	}
+
+	err = enrolltokenConsume(path, enrolltokenTestCsr(t, "node1"))
+	if err == nil {
+		t.Error("Expected a consumed token to be rejected for another key")
+	}
+}
+
+func TestEnrolltokenBeforeApproval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enrolltoken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tokens.json")
+	registry := enrolltokenRegistry{
+		Tokens: []enrolltokenEntry{
+			{Name: "node1", TokenSha256: enrolltokenHash("s3cret")},
+		},
+	}
+	err = enrolltokenRegistrySave(path, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signcert, signkey := catestSigner(t)
+	config := caconfig{Datadir: dir, EnrollmentTokens: path, RequireApproval: true}
+	serials, err := caserialsFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token is bound to the first key while its request waits
+	// for approval
+	req := cacsr{from: "unprovisioned", source: "mqtt", csr: enrolltokenTestCsr(t, "node1")}
+	_, err = caIssue(config, serials, signcert, signkey, req, time.Hour)
+	if _, isPending := err.(capendingError); !isPending {
+		t.Fatalf("Expected the request to wait for approval, got %v", err)
+	}
+
+	other := cacsr{from: "unprovisioned", source: "mqtt", csr: enrolltokenTestCsr(t, "node1")}
+	_, err = caIssue(config, serials, signcert, signkey, other, time.Hour)
+	if _, isPending := err.(capendingError); isPending || err == nil {
+		t.Errorf("Expected the token to be rejected for another key, got %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Enrollment over Secure Transport (RFC 7030). The client side is an
+// enroller for the node, and the server side is an alternative
+// frontend for the CA.
+
+const estPathPrefix = "/.well-known/est/"
+
+// Seconds after which a node should repeat a CSR which is waiting
+// for approval
+const estRetryAfter = "600"
+
+type enrollerEst struct {
+	server  string
+	results chan []*x509.Certificate
+	errors  chan error
+}
+
+func enrollerEstNew(server string) enrollerEst {
+	return enrollerEst{
+		server:  strings.TrimSuffix(server, "/"),
+		results: make(chan []*x509.Certificate),
+		errors:  make(chan error),
+	}
+}
+
+func (e enrollerEst) enroll(csr *x509.CertificateRequest, tlsconf *tls.Config, renewal bool) {
+	go func() {
+		certs, err := estEnroll(e.server, csr, tlsconf, renewal)
+		if err != nil {
+			e.errors <- err
+			return
+		}
+
+		e.results <- certs
+	}()
+}
+
+func (e enrollerEst) clear() {
+}
+
+func (e enrollerEst) certs() <-chan []*x509.Certificate {
+	return e.results
+}
+
+func (e enrollerEst) failures() <-chan error {
+	return e.errors
+}
+
+func estClient(tlsconf *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsconf,
+		},
+		Timeout: time.Minute,
+	}
+}
+
+func estEnroll(
+	server string,
+	csr *x509.CertificateRequest,
+	tlsconf *tls.Config,
+	renewal bool,
+) ([]*x509.Certificate, error) {
+	operation := "simpleenroll"
+	if renewal {
+		operation = "simplereenroll"
+	}
+
+	client := estClient(tlsconf)
+	body := base64.StdEncoding.EncodeToString(csr.Raw)
+
+	req, err := http.NewRequest(http.MethodPost, server+"/"+operation, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/pkcs10")
+	req.Header.Set("Content-Transfer-Encoding", "base64")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to post to %s: %w", operation, err)
+	}
+	defer res.Body.Close()
+
+	certs, err := estReadCerts(res)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w", operation, err)
+	}
+
+	if len(certs) > 1 {
+		return certs, nil
+	}
+
+	// Only the leaf was returned, so the intermediates need
+	// to be looked up separately.
+	cacerts, err := estCacerts(client, server)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cacert := range cacerts {
+		if !bytes.Equal(cacert.RawIssuer, cacert.RawSubject) {
+			certs = append(certs, cacert)
+		}
+	}
+
+	return certs, nil
+}
+
+func estCacerts(client *http.Client, server string) ([]*x509.Certificate, error) {
+	res, err := client.Get(server + "/cacerts")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cacerts: %w", err)
+	}
+	defer res.Body.Close()
+
+	certs, err := estReadCerts(res)
+	if err != nil {
+		return nil, fmt.Errorf("cacerts failed: %w", err)
+	}
+
+	return certs, nil
+}
+
+func estReadCerts(res *http.Response) ([]*x509.Certificate, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusAccepted {
+		return nil, enrollPendingError{reason: strings.TrimSpace(string(body))}
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(
+			"server responded with %s: %s",
+			res.Status,
+			strings.TrimSpace(string(body)),
+		)
+	}
+
+	der, err := estDecodeBase64(body)
+	if err != nil {
+		return nil, err
+	}
+
+	certs, err := pkcs7DecodeCerts(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("server responded with no certificates")
+	}
+
+	return certs, nil
+}
+
+func estDecodeBase64(body []byte) ([]byte, error) {
+	stripped := strings.Join(strings.Fields(string(body)), "")
+	return base64.StdEncoding.DecodeString(stripped)
+}
+
+func estWriteCerts(w http.ResponseWriter, certs []*x509.Certificate) {
+	der, err := pkcs7EncodeCerts(certs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=certs-only")
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	io.WriteString(w, base64.StdEncoding.EncodeToString(der))
+}
+
+func estServeCacerts(w http.ResponseWriter, r *http.Request, cacerts []*x509.Certificate) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "expected GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	estWriteCerts(w, cacerts)
+}
+
+func estServeEnroll(
+	w http.ResponseWriter,
+	r *http.Request,
+	renewal bool,
+	signcert *x509.Certificate,
+	csrs chan<- cacsr,
+) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "client certificate required", http.StatusUnauthorized)
+		return
+	}
+	sender := r.TLS.PeerCertificates[0].Subject.CommonName
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	der, err := estDecodeBase64(body)
+	if err != nil {
+		http.Error(w, "failed to decode base64", http.StatusBadRequest)
+		return
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		http.Error(w, "failed to parse CSR", http.StatusBadRequest)
+		return
+	}
+
+	err = csr.CheckSignature()
+	if err != nil {
+		http.Error(w, "bad CSR signature", http.StatusBadRequest)
+		return
+	}
+
+	if renewal && csr.Subject.CommonName != sender {
+		http.Error(w, "re-enrollment must keep the subject", http.StatusBadRequest)
+		return
+	}
+
+	results := make(chan caresult, 1)
+	csrs <- cacsr{
+		from:       sender,
+		fromSerial: r.TLS.PeerCertificates[0].SerialNumber.String(),
+		source:     "est",
+		csr:        csr,
+		reply: func(cert *x509.Certificate, err error) {
+			results <- caresult{cert: cert, err: err}
+		},
+	}
+
+	result := <-results
+	if _, isPending := result.err.(capendingError); isPending {
+		w.Header().Set("Retry-After", estRetryAfter)
+		http.Error(w, result.err.Error(), http.StatusAccepted)
+		return
+	}
+	if _, isLimited := result.err.(calimitError); isLimited {
+		w.Header().Set("Retry-After", estRetryAfter)
+		http.Error(w, result.err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if _, isPolicy := result.err.(capolicyError); isPolicy {
+		http.Error(w, result.err.Error(), http.StatusForbidden)
+		return
+	}
+	if result.err != nil {
+		http.Error(w, result.err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	estWriteCerts(w, []*x509.Certificate{result.cert, signcert})
+}
+
+func caEstServer(
+	addr string,
+	tlsconf *tls.Config,
+	signcert *x509.Certificate,
+	rootcert *x509.Certificate,
+	csrs chan<- cacsr,
+) *http.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(estPathPrefix+"cacerts", func(w http.ResponseWriter, r *http.Request) {
+		estServeCacerts(w, r, []*x509.Certificate{signcert, rootcert})
+	})
+	mux.HandleFunc(estPathPrefix+"simpleenroll", func(w http.ResponseWriter, r *http.Request) {
+		estServeEnroll(w, r, false, signcert, csrs)
+	})
+	mux.HandleFunc(estPathPrefix+"simplereenroll", func(w http.ResponseWriter, r *http.Request) {
+		estServeEnroll(w, r, true, signcert, csrs)
+	})
+
+	return &http.Server{
+		Addr:      addr,
+		Handler:   mux,
+		TLSConfig: tlsconf,
+	}
+}
+
+func caEstTlsConfig(rootcert *x509.Certificate, servercert tls.Certificate) *tls.Config {
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(rootcert)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{servercert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+}
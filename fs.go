@@ -1,7 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
 )
 
 func fsCheckDirPresent(datadir string) error {
@@ -18,3 +22,65 @@ func fsCheckDirPresent(datadir string) error {
 
 	return os.Mkdir(datadir, 0700)
 }
+
+func fsWriteFileAtomic(path string, content []byte, perm os.FileMode) error {
+	tmppath := path + ".tmp"
+
+	// A leftover could have other permissions than perm
+	os.Remove(tmppath)
+
+	f, err := os.OpenFile(tmppath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmppath)
+		return err
+	}
+
+	err = os.Rename(tmppath, path)
+	if err != nil {
+		return err
+	}
+
+	// The rename is durable only once the directory is synced
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// Takes an exclusive lock on path, which is created if needed. The
+// lock is held until the returned function is called. Locks are per
+// open file, so taking the same lock twice in a process blocks too.
+func fsLock(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock %s: %w", path, err)
+	}
+
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	return func() {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
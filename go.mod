@@ -7,4 +7,7 @@ require (
 	golang.org/x/sys v0.0.0-20211102192858-4dd72447c267
 )
 
-require golang.org/x/net v0.0.0-20211101193420-4a448f8816b3 // indirect
+require (
+	github.com/miekg/pkcs11 v1.1.1
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+)
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Encryption of the node key at rest. The key-encryption key (KEK)
+// comes from exactly one of the sources, and the AES-256-GCM key is
+// the SHA-256 of it, so the source should hold plenty of entropy.
+type kekconfig struct {
+	File    string   `json:"file"`
+	Keyring string   `json:"keyring"`
+	Command []string `json:"command"`
+}
+
+const keycryptPemType = "JOONOS ENCRYPTED PRIVATE KEY"
+
+func kekKeyring(description string) ([]byte, error) {
+	var id int
+	var err error
+	for _, ring := range []int{unix.KEY_SPEC_USER_KEYRING, unix.KEY_SPEC_SESSION_KEYRING} {
+		id, err = unix.KeyctlSearch(ring, "user", description, 0)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no key %s in the user or session keyring: %w", description, err)
+	}
+
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+	_, err = unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// Reads the secret from the configured source, without surrounding
+// whitespace. What names the secret in errors.
+func kekSecret(conf kekconfig, what string) ([]byte, error) {
+	var secret []byte
+	var err error
+
+	switch {
+	case len(conf.File) > 0:
+		secret, err = ioutil.ReadFile(conf.File)
+	case len(conf.Keyring) > 0:
+		secret, err = kekKeyring(conf.Keyring)
+	case len(conf.Command) > 0:
+		cmd := exec.Command(conf.Command[0], conf.Command[1:]...)
+		cmd.Stderr = os.Stderr
+		secret, err = cmd.Output()
+	default:
+		return nil, fmt.Errorf("no source for the %s", what)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", what, err)
+	}
+
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%s is empty", what)
+	}
+
+	return secret, nil
+}
+
+func kekLoad(conf kekconfig) ([]byte, error) {
+	secret, err := kekSecret(conf, "key-encryption key")
+	if err != nil {
+		return nil, err
+	}
+
+	kek := sha256.Sum256(secret)
+	return kek[:], nil
+}
+
+func keycryptAead(kek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func keycryptEncrypt(der []byte, kek []byte) (*pem.Block, error) {
+	aead, err := keycryptAead(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{
+		Type: keycryptPemType,
+		Headers: map[string]string{
+			"Cipher": "AES-256-GCM",
+			"Nonce":  hex.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, der, []byte(keycryptPemType)),
+	}, nil
+}
+
+func keycryptDecrypt(block *pem.Block, kek []byte) ([]byte, error) {
+	if block.Headers["Cipher"] != "AES-256-GCM" {
+		return nil, fmt.Errorf("unsupported cipher %s", block.Headers["Cipher"])
+	}
+
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, fmt.Errorf("bad nonce: %w", err)
+	}
+
+	aead, err := keycryptAead(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("bad nonce length %d", len(nonce))
+	}
+
+	der, err := aead.Open(nil, nonce, block.Bytes, []byte(keycryptPemType))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt key, wrong key-encryption key?")
+	}
+
+	return der, nil
+}
+
+// Checks that a private key file is owned by us and that nobody else
+// could have replaced it. Keys written by earlier versions were
+// readable by others, so their permissions are restricted here rather
+// than refused, as that would leave remote nodes unable to start.
+func keycryptCheckFile(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by uid %d, expected %d", path, stat.Uid, os.Getuid())
+	}
+
+	if info.Mode().Perm()&0002 != 0 {
+		return fmt.Errorf("%s is writable by anyone, the key can not be trusted", path)
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		fmt.Printf("Warning: %s had permissions %v, restricting them to 0600\n", path, info.Mode().Perm())
+		err = os.Chmod(path, 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
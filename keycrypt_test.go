@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeycryptRoundtrip(t *testing.T) {
+	kek, err := kekLoad(kekconfig{Command: []string{"echo", "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der := []byte("not really a key")
+	block, err := keycryptEncrypt(der, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := keycryptDecrypt(block, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, der) {
+		t.Errorf("Expected %q, got %q", der, decrypted)
+	}
+
+	otherKek, err := kekLoad(kekconfig{Command: []string{"echo", "other"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = keycryptDecrypt(block, otherKek)
+	if err == nil {
+		t.Error("Expected decryption with another key to fail")
+	}
+}
+
+func TestKeycryptCheckFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keycrypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// As written by versions which used os.Create
+	path := filepath.Join(dir, "node.key.pem")
+	err = ioutil.WriteFile(path, []byte("key"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chmod(path, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = keycryptCheckFile(path)
+	if err != nil {
+		t.Fatalf("Expected an old key to be accepted: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the permissions to be restricted to 0600, got %v", info.Mode().Perm())
+	}
+
+	err = os.Chmod(path, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = keycryptCheckFile(path)
+	if err == nil {
+		t.Error("Expected a key writable by anyone to be refused")
+	}
+}
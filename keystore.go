@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// keystore keeps the private key of the node. New keys are first
+// generated as pending keys for a CSR, and only committed as the node
+// key once a matching certificate has been received. Pending keys
+// only need to be saved when the certificate arrives in another
+// process, as with offline provisioning. Archive moves the node key
+// out of use when the node is deprovisioned.
+type keystore interface {
+	generate() (crypto.Signer, error)
+	savePending(key crypto.Signer) error
+	loadPending() (crypto.Signer, error)
+	commit(key crypto.Signer) error
+	load() (crypto.Signer, error)
+	archive(dir string) error
+}
+
+// A key in a PKCS#11 token, which is only supported when built with
+// -tags pkcs11, as the module is loaded through cgo
+type pkcs11config struct {
+	Module     string `json:"module"`
+	TokenLabel string `json:"token-label"`
+	Pin        string `json:"pin"`
+	KeyLabel   string `json:"key-label"`
+}
+
+type keystoreFile struct {
+	path    string
+	pending string
+	kek     []byte
+}
+
+func keystoreFromConfig(config config) (keystore, error) {
+	if config.Pkcs11 != nil {
+		return pkcs11Open(*config.Pkcs11)
+	}
+
+	keys := keystoreFile{
+		path:    config.Nodekey(),
+		pending: config.NodekeyPending(),
+	}
+
+	if config.KeyEncryption != nil {
+		kek, err := kekLoad(*config.KeyEncryption)
+		if err != nil {
+			return nil, err
+		}
+		keys.kek = kek
+	}
+
+	return keys, nil
+}
+
+func (k keystoreFile) generate() (crypto.Signer, error) {
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+func (k keystoreFile) savePending(key crypto.Signer) error {
+	return certWriteKey(k.pending, key, k.kek)
+}
+
+func (k keystoreFile) loadPending() (crypto.Signer, error) {
+	return k.loadPath(k.pending)
+}
+
+func (k keystoreFile) commit(key crypto.Signer) error {
+	err := certWriteKey(k.path, key, k.kek)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(k.pending)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (k keystoreFile) load() (crypto.Signer, error) {
+	return k.loadPath(k.path)
+}
+
+func (k keystoreFile) loadPath(path string) (crypto.Signer, error) {
+	keyPem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(keyPem)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+
+	if block.Type == keycryptPemType {
+		if k.kek == nil {
+			return nil, fmt.Errorf("%s is encrypted, but no key-encryption is configured", path)
+		}
+
+		der, err := keycryptDecrypt(block, k.kek)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		return keyParse(der)
+	}
+
+	key, err := keyParse(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.kek != nil {
+		// Stored before encryption was configured
+		err = certWriteKey(path, key, k.kek)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt %s: %w", path, err)
+		}
+	}
+
+	return key, nil
+}
+
+func (k keystoreFile) archive(dir string) error {
+	for _, path := range []string{k.path, k.pending} {
+		err := os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func keyParse(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+
+	return nil, fmt.Errorf("unsupported private key type %T", key)
+}
@@ -8,7 +8,9 @@ import (
 func main() {
 	subcommands := []*subcommand{
 		caSubcommand(),
+		certRenewSubcommand(),
 		certShowSubcommand(),
+		deprovisionSubcommand(),
 		mqttConnectSubcmd(),
 		offlineSubcommand(),
 		runSubcommand(),
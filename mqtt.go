@@ -7,6 +7,7 @@ import (
 	"flag"
 	"fmt"
 	"net/url"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -42,7 +43,10 @@ type mqttservice struct {
 	stop       chan<- struct{}
 	sysdesc    chan<- sysdesc
 	sysstat    chan<- sysstat
+	certstatus chan<- certstatus
 	upgcmds    <-chan upgCommand
+	renewcmds  <-chan renewCommand
+	rejections <-chan error
 }
 
 func mqttRunOnce(
@@ -53,7 +57,10 @@ func mqttRunOnce(
 	stop <-chan struct{},
 	sysdesc <-chan sysdesc,
 	sysstat <-chan sysstat,
+	certstatus <-chan certstatus,
 	upgcmds chan<- upgCommand,
+	renewcmds chan<- renewCommand,
+	rejections chan<- error,
 	csrsIn <-chan *x509.CertificateRequest,
 	certsOut chan<- []*x509.Certificate) {
 
@@ -75,7 +82,42 @@ func mqttRunOnce(
 	topicCsr := fmt.Sprintf("joonos/%s/csr", mqttName)
 	topicSysdesc := fmt.Sprintf("joonos/%s/status/description", mqttName)
 	topicSysstat := fmt.Sprintf("joonos/%s/status/stat", mqttName)
+	topicCertstatus := fmt.Sprintf("joonos/%s/status/cert", mqttName)
 	topicSwupdate := fmt.Sprintf("joonos/%s/upgrade", mqttName)
+	topicRenew := fmt.Sprintf("joonos/%s/renew", mqttName)
+	topicRejected := topicCsr + "/rejected"
+	topicPending := topicCsr + "/pending"
+
+	// Provisioning nodes share the topics, so rejections are
+	// matched with the key of the CSR which this node published
+	var pendingMu sync.Mutex
+	pendingKey := ""
+
+	onRejection := func(pending bool) mqtt.MessageHandler {
+		return func(c mqtt.Client, m mqtt.Message) {
+			var rejection carejection
+
+			err := json.Unmarshal(m.Payload(), &rejection)
+			if err != nil {
+				messages <- fmt.Sprintf("failed to read rejection: %v", err)
+				return
+			}
+
+			pendingMu.Lock()
+			ours := len(pendingKey) > 0 && rejection.KeySha256 == pendingKey
+			pendingMu.Unlock()
+
+			if !ours {
+				return
+			}
+
+			if pending {
+				rejections <- enrollPendingError{reason: rejection.Reason}
+			} else {
+				rejections <- rejection
+			}
+		}
+	}
 
 	opts.SetAutoReconnect(true)
 	opts.SetUsername(mqttName)
@@ -113,6 +155,25 @@ func mqttRunOnce(
 			upgcmds <- cmd
 		}).Wait()
 
+		c.Subscribe(topicRejected, 1, onRejection(false)).Wait()
+		c.Subscribe(topicPending, 1, onRejection(true)).Wait()
+
+		if !params.provisioning {
+			c.Subscribe(topicRenew, 1, func(c mqtt.Client, m mqtt.Message) {
+				var cmd renewCommand
+
+				if len(m.Payload()) > 0 {
+					err := json.Unmarshal(m.Payload(), &cmd)
+					if err != nil {
+						messages <- fmt.Sprintf("failed to read renew cmd: %v", err)
+						return
+					}
+				}
+
+				renewcmds <- cmd
+			}).Wait()
+		}
+
 		didconnect <- mqttdidconnect{
 			provisioning: params.provisioning,
 		}
@@ -155,16 +216,28 @@ func mqttRunOnce(
 					client.Publish(topicSysstat, 1, true, payload)
 				}
 			}
+		case status := <-certstatus:
+			if !params.provisioning {
+				payload, err := json.Marshal(&status)
+				if err == nil {
+					client.Publish(topicCertstatus, 1, true, payload)
+				}
+			}
 		case csr := <-csrsIn:
 			payload := []byte{}
 
 			var msg string
+			key := ""
 			if csr != nil {
 				payload = csr.Raw
+				key = certKeyFingerprint(csr.RawSubjectPublicKeyInfo)
 				msg = fmt.Sprintf("Published CSR at %s", topicCsr)
 			} else {
 				msg = fmt.Sprintf("Cleared csr at %s", topicCsr)
 			}
+			pendingMu.Lock()
+			pendingKey = key
+			pendingMu.Unlock()
 			client.Publish(topicCsr, 1, true, payload).Wait()
 			messages <- msg
 		case <-stop:
@@ -185,7 +258,10 @@ func mqttStartNode() mqttservice {
 	certs := make(chan []*x509.Certificate)
 	sysdescs := make(chan sysdesc)
 	sysstats := make(chan sysstat)
+	certstatuses := make(chan certstatus)
 	swupdates := make(chan upgCommand)
+	renewals := make(chan renewCommand)
+	rejections := make(chan error)
 	stop := make(chan struct{})
 	mqttFailed := make(chan string)
 
@@ -201,7 +277,10 @@ func mqttStartNode() mqttservice {
 				stopCurrent,
 				sysdescs,
 				sysstats,
+				certstatuses,
 				swupdates,
+				renewals,
+				rejections,
 				csrs,
 				certs,
 			)
@@ -231,7 +310,10 @@ func mqttStartNode() mqttservice {
 		stop:       stop,
 		sysdesc:    sysdescs,
 		sysstat:    sysstats,
+		certstatus: certstatuses,
 		upgcmds:    swupdates,
+		renewcmds:  renewals,
+		rejections: rejections,
 	}
 }
 
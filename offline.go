@@ -3,11 +3,14 @@ package main
 import (
 	"bytes"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
 func offlineReadUntilEof(f io.Reader) ([]byte, error) {
@@ -50,7 +53,7 @@ func offlineProvision(configpath string) error {
 		fmt.Println("Unexpected error for node cert:", state.nodecerterr)
 	}
 
-	csr, err := state.csr()
+	csr, err := state.csr(true)
 	if err != nil {
 		return err
 	}
@@ -77,12 +80,141 @@ func offlineProvision(configpath string) error {
 	return nil
 }
 
+// Writes a bundle for the CA into dir/<node>. The key stays pending
+// in the key store until offlineImport.
+func offlineExport(configpath string, dir string) error {
+	config, err := configLoad(configpath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	state, err := stateLoad(config)
+	if err != nil {
+		return fmt.Errorf("failed to initialize state: %w", err)
+	}
+
+	if state.nodecert != nil && state.nodecerterr == nil {
+		fmt.Println("Node certificate is already set up.")
+		return nil
+	}
+
+	csr, err := state.csr(true)
+	if err != nil {
+		return err
+	}
+
+	err = state.keys.savePending(state.csrkey)
+	if err != nil {
+		return fmt.Errorf("failed to save pending key: %w", err)
+	}
+
+	bundle := filepath.Join(dir, state.nodename)
+	err = os.MkdirAll(bundle, 0700)
+	if err != nil {
+		return err
+	}
+
+	// A certificate from an earlier round would not match the key
+	err = os.Remove(filepath.Join(bundle, bundleCert))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	csrPem := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: csr.Raw,
+	})
+
+	sysdesc, err := json.MarshalIndent(sysdescLoad(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	pubkey, err := x509.MarshalPKIXPublicKey(state.csrkey.Public())
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{bundleCsr, csrPem},
+		{bundleSysdesc, append(sysdesc, '\n')},
+		{bundleKeyPending, []byte(certKeyFingerprint(pubkey) + "\n")},
+	}
+
+	for _, file := range files {
+		err = fsWriteFileAtomic(filepath.Join(bundle, file.name), file.content, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("Wrote bundle to", bundle)
+
+	return nil
+}
+
+// Installs the certificate chain from the bundle in dir/<node>
+func offlineImport(configpath string, dir string) error {
+	config, err := configLoad(configpath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	state, err := stateLoad(config)
+	if err != nil {
+		return fmt.Errorf("failed to initialize state: %w", err)
+	}
+
+	bundle := filepath.Join(dir, state.nodename)
+	certPem, err := ioutil.ReadFile(filepath.Join(bundle, bundleCert))
+	if err != nil {
+		return fmt.Errorf("no certificate in bundle: %w", err)
+	}
+
+	certs, err := certDecodePem(certPem)
+	if err != nil {
+		return err
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificates in %s", bundle)
+	}
+
+	key, err := state.keys.loadPending()
+	if err != nil {
+		return fmt.Errorf("no pending key, was the bundle exported here? %w", err)
+	}
+	state.csrkey = key
+
+	err = state.setCertificates(certs)
+	if err != nil {
+		return fmt.Errorf("failed to install certificates: %w", err)
+	}
+
+	fmt.Println("Installed certificate:", certDesc(certs[0]))
+
+	return nil
+}
+
 func offlineSubcommand() *subcommand {
 	flagset := flag.NewFlagSet("offline-provision", flag.ExitOnError)
 	args := commonArgs{}
 	commonFlags(flagset, &args)
 
+	export := flagset.String("export", "", "write a CSR bundle to this directory instead of stdout")
+	importDir := flagset.String("import", "", "install the certificate from a bundle in this directory")
+
 	run := func() error {
+		switch {
+		case len(*export) > 0 && len(*importDir) > 0:
+			return fmt.Errorf("expected only one of -export and -import")
+		case len(*export) > 0:
+			return offlineExport(args.config, *export)
+		case len(*importDir) > 0:
+			return offlineImport(args.config, *importDir)
+		}
 		return offlineProvision(args.config)
 	}
 
@@ -0,0 +1,440 @@
+//go:build pkcs11
+// +build pkcs11
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"path/filepath"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// A PKCS#11 token session, shared by the keystore and the signers
+// which it hands out. Sessions are not safe for concurrent use, so
+// everything goes through the mutex.
+type pkcs11session struct {
+	mu     sync.Mutex
+	ctx    *pkcs11.Ctx
+	handle pkcs11.SessionHandle
+}
+
+type pkcs11keystore struct {
+	session  *pkcs11session
+	keylabel string
+}
+
+// An RSA or ECDSA key pair in the token
+type pkcs11signer struct {
+	session *pkcs11session
+	pubkey  crypto.PublicKey
+	privobj pkcs11.ObjectHandle
+	pubobj  pkcs11.ObjectHandle
+}
+
+// DigestInfo prefixes for PKCS#1 v1.5 signatures, as in crypto/rsa
+var pkcs11HashPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+var pkcs11Curves = map[string]elliptic.Curve{
+	asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}.String(): elliptic.P256(),
+	asn1.ObjectIdentifier{1, 3, 132, 0, 34}.String():          elliptic.P384(),
+	asn1.ObjectIdentifier{1, 3, 132, 0, 35}.String():          elliptic.P521(),
+}
+
+var pkcs11PssHashes = map[crypto.Hash][2]uint{
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+func pkcs11SessionOpen(conf pkcs11config) (*pkcs11session, error) {
+	ctx := pkcs11.New(conf.Module)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module %s", conf.Module)
+	}
+
+	err := ctx.Initialize()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize %s: %w", conf.Module, err)
+	}
+
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PKCS#11 slots: %w", err)
+	}
+
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil || info.Label != conf.TokenLabel {
+			continue
+		}
+
+		handle, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open session on %s: %w", conf.TokenLabel, err)
+		}
+
+		err = ctx.Login(handle, pkcs11.CKU_USER, conf.Pin)
+		if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			return nil, fmt.Errorf("failed to log in to %s: %w", conf.TokenLabel, err)
+		}
+
+		return &pkcs11session{ctx: ctx, handle: handle}, nil
+	}
+
+	return nil, fmt.Errorf("no PKCS#11 token labeled %s", conf.TokenLabel)
+}
+
+func pkcs11Open(conf pkcs11config) (keystore, error) {
+	session, err := pkcs11SessionOpen(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	keylabel := conf.KeyLabel
+	if len(keylabel) == 0 {
+		keylabel = "joonos-node"
+	}
+
+	return &pkcs11keystore{
+		session:  session,
+		keylabel: keylabel,
+	}, nil
+}
+
+func (s *pkcs11session) findObjects(template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	err := s.ctx.FindObjectsInit(s.handle, template)
+	if err != nil {
+		return nil, err
+	}
+	defer s.ctx.FindObjectsFinal(s.handle)
+
+	res := []pkcs11.ObjectHandle{}
+	for {
+		objs, _, err := s.ctx.FindObjects(s.handle, 16)
+		if err != nil {
+			return nil, err
+		}
+		if len(objs) == 0 {
+			return res, nil
+		}
+		res = append(res, objs...)
+	}
+}
+
+func (s *pkcs11session) findKey(class uint, label string) (pkcs11.ObjectHandle, error) {
+	objs, err := s.findObjects([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(objs) != 1 {
+		return 0, fmt.Errorf("expected one key labeled %s, found %d", label, len(objs))
+	}
+
+	return objs[0], nil
+}
+
+func (s *pkcs11session) destroyLabeled(label string) error {
+	objs, err := s.findObjects([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range objs {
+		err = s.ctx.DestroyObject(s.handle, obj)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Finds the key pair labeled with label. The lock must be held.
+func (s *pkcs11session) signerByLabel(label string) (*pkcs11signer, error) {
+	privobj, err := s.findKey(pkcs11.CKO_PRIVATE_KEY, label)
+	if err != nil {
+		return nil, err
+	}
+
+	pubobj, err := s.findKey(pkcs11.CKO_PUBLIC_KEY, label)
+	if err != nil {
+		return nil, err
+	}
+
+	pubkey, err := s.publicKey(pubobj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key %s: %w", label, err)
+	}
+
+	return &pkcs11signer{
+		session: s,
+		pubkey:  pubkey,
+		privobj: privobj,
+		pubobj:  pubobj,
+	}, nil
+}
+
+// Reads an RSA public key, or failing that an EC one. The lock must be
+// held.
+func (s *pkcs11session) publicKey(pubobj pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	attrs, err := s.ctx.GetAttributeValue(s.handle, pubobj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err == nil {
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}, nil
+	}
+
+	attrs, err = s.ctx.GetAttributeValue(s.handle, pubobj, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("neither an RSA nor an EC key: %w", err)
+	}
+
+	var oid asn1.ObjectIdentifier
+	_, err = asn1.Unmarshal(attrs[0].Value, &oid)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported EC parameters: %w", err)
+	}
+
+	curve, found := pkcs11Curves[oid.String()]
+	if !found {
+		return nil, fmt.Errorf("unsupported curve %s", oid)
+	}
+
+	// The point should be in an OCTET STRING, but some tokens
+	// leave it out
+	point := attrs[1].Value
+	var wrapped []byte
+	if rest, err := asn1.Unmarshal(point, &wrapped); err == nil && len(rest) == 0 {
+		point = wrapped
+	}
+
+	x, y := elliptic.Unmarshal(curve, point)
+	if x == nil {
+		return nil, fmt.Errorf("malformed EC point")
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func (k *pkcs11keystore) pendingLabel() string {
+	return k.keylabel + "-pending"
+}
+
+func (k *pkcs11keystore) generate() (crypto.Signer, error) {
+	s := k.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	label := k.pendingLabel()
+
+	err := s.destroyLabeled(label)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove old pending key: %w", err)
+	}
+
+	pubtemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	privtemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+
+	_, _, err = s.ctx.GenerateKeyPair(
+		s.handle,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)},
+		pubtemplate,
+		privtemplate,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key in token: %w", err)
+	}
+
+	return s.signerByLabel(label)
+}
+
+// Pending keys stay in the token under the pending label
+func (k *pkcs11keystore) savePending(key crypto.Signer) error {
+	signer, isPkcs11 := key.(*pkcs11signer)
+	if !isPkcs11 || signer.session != k.session {
+		return fmt.Errorf("key was not generated in this token")
+	}
+
+	return nil
+}
+
+func (k *pkcs11keystore) loadPending() (crypto.Signer, error) {
+	s := k.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.signerByLabel(k.pendingLabel())
+}
+
+func (k *pkcs11keystore) commit(key crypto.Signer) error {
+	signer, isPkcs11 := key.(*pkcs11signer)
+	if !isPkcs11 || signer.session != k.session {
+		return fmt.Errorf("key was not generated in this token")
+	}
+
+	s := k.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.destroyLabeled(k.keylabel)
+	if err != nil {
+		return fmt.Errorf("failed to remove previous node key: %w", err)
+	}
+
+	label := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, k.keylabel)}
+	for _, obj := range []pkcs11.ObjectHandle{signer.privobj, signer.pubobj} {
+		err = s.ctx.SetAttributeValue(s.handle, obj, label)
+		if err != nil {
+			return fmt.Errorf("failed to relabel key: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (k *pkcs11keystore) load() (crypto.Signer, error) {
+	s := k.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.signerByLabel(k.keylabel)
+}
+
+// The key can not leave the token, so it is archived by relabeling it
+// after the archive directory
+func (k *pkcs11keystore) archive(dir string) error {
+	s := k.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.destroyLabeled(k.pendingLabel())
+	if err != nil {
+		return fmt.Errorf("failed to remove pending key: %w", err)
+	}
+
+	objs, err := s.findObjects([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, k.keylabel),
+	})
+	if err != nil {
+		return err
+	}
+
+	label := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, k.keylabel+"-archived-"+filepath.Base(dir)),
+	}
+	for _, obj := range objs {
+		err = s.ctx.SetAttributeValue(s.handle, obj, label)
+		if err != nil {
+			return fmt.Errorf("failed to relabel key: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (k *pkcs11signer) Public() crypto.PublicKey {
+	return k.pubkey
+}
+
+func (k *pkcs11signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := opts.HashFunc()
+
+	var mechanism *pkcs11.Mechanism
+	var message []byte
+
+	if _, isEc := k.pubkey.(*ecdsa.PublicKey); isEc {
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)
+		message = digest
+	} else if pssOpts, isPss := opts.(*rsa.PSSOptions); isPss {
+		hashes, found := pkcs11PssHashes[hash]
+		if !found {
+			return nil, fmt.Errorf("unsupported hash for PSS: %v", hash)
+		}
+
+		saltLength := pssOpts.SaltLength
+		if saltLength == rsa.PSSSaltLengthAuto || saltLength == rsa.PSSSaltLengthEqualsHash {
+			saltLength = hash.Size()
+		}
+
+		mechanism = pkcs11.NewMechanism(
+			pkcs11.CKM_RSA_PKCS_PSS,
+			pkcs11.NewPSSParams(hashes[0], hashes[1], uint(saltLength)),
+		)
+		message = digest
+	} else {
+		prefix, found := pkcs11HashPrefixes[hash]
+		if !found {
+			return nil, fmt.Errorf("unsupported hash: %v", hash)
+		}
+
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+		message = append(append([]byte{}, prefix...), digest...)
+	}
+
+	s := k.session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.ctx.SignInit(s.handle, []*pkcs11.Mechanism{mechanism}, k.privobj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize signing: %w", err)
+	}
+
+	signature, err := s.ctx.Sign(s.handle, message)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, isEc := k.pubkey.(*ecdsa.PublicKey); !isEc {
+		return signature, nil
+	}
+
+	// The token returns r and s concatenated, while Go expects
+	// them in an ASN.1 sequence
+	half := len(signature) / 2
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		R: new(big.Int).SetBytes(signature[:half]),
+		S: new(big.Int).SetBytes(signature[half:]),
+	})
+}
@@ -0,0 +1,12 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package main
+
+import (
+	"fmt"
+)
+
+func pkcs11Open(conf pkcs11config) (keystore, error) {
+	return nil, fmt.Errorf("built without PKCS#11 support, rebuild with -tags pkcs11")
+}
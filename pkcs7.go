@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+)
+
+// Just enough PKCS#7 for the degenerate "certs-only" SignedData
+// messages which EST uses for transferring certificates.
+
+var (
+	pkcs7OidData       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	pkcs7OidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+)
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+func pkcs7EncodeCerts(certs []*x509.Certificate) ([]byte, error) {
+	emptySet, err := asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassUniversal,
+		Tag:        asn1.TagSet,
+		IsCompound: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := asn1.Marshal(1)
+	if err != nil {
+		return nil, err
+	}
+
+	innerContent, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+	}{pkcs7OidData})
+	if err != nil {
+		return nil, err
+	}
+
+	certBytes := []byte{}
+	for _, cert := range certs {
+		certBytes = append(certBytes, cert.Raw...)
+	}
+
+	certSet, err := asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      certBytes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signedDataBytes := []byte{}
+	for _, elem := range [][]byte{version, emptySet, innerContent, certSet, emptySet} {
+		signedDataBytes = append(signedDataBytes, elem...)
+	}
+
+	signedData, err := asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassUniversal,
+		Tag:        asn1.TagSequence,
+		IsCompound: true,
+		Bytes:      signedDataBytes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(pkcs7ContentInfo{
+		ContentType: pkcs7OidSignedData,
+		Content: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      signedData,
+		},
+	})
+}
+
+func pkcs7DecodeCerts(der []byte) ([]*x509.Certificate, error) {
+	var contentInfo pkcs7ContentInfo
+	rest, err := asn1.Unmarshal(der, &contentInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PKCS#7 content info: %w", err)
+	}
+
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("trailing garbage after PKCS#7 content info")
+	}
+
+	if !contentInfo.ContentType.Equal(pkcs7OidSignedData) {
+		return nil, fmt.Errorf("expected PKCS#7 signed data, got %v", contentInfo.ContentType)
+	}
+
+	// The content is wrapped in an explicit [0] tag
+	var signedData asn1.RawValue
+	_, err = asn1.Unmarshal(contentInfo.Content.Bytes, &signedData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PKCS#7 signed data: %w", err)
+	}
+
+	elems := signedData.Bytes
+	for len(elems) > 0 {
+		var elem asn1.RawValue
+		elems, err = asn1.Unmarshal(elems, &elem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse PKCS#7 signed data: %w", err)
+		}
+
+		if elem.Class == asn1.ClassContextSpecific && elem.Tag == 0 {
+			return x509.ParseCertificates(elem.Bytes)
+		}
+	}
+
+	return nil, fmt.Errorf("no certificates in PKCS#7 signed data")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPkcs7RoundTrip(t *testing.T) {
+	certs, err := certLoadFromPath("test-files/unprovisioned.cert.pem")
+	if err != nil {
+		t.Fatalf("Failed to load certificates: %v", err)
+	}
+
+	der, err := pkcs7EncodeCerts(certs)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	decoded, err := pkcs7DecodeCerts(der)
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	if len(decoded) != len(certs) {
+		t.Fatalf("Expected %d certs, got %d", len(certs), len(decoded))
+	}
+
+	for n := range certs {
+		if !decoded[n].Equal(certs[n]) {
+			t.Errorf("Certificate %d differs after round trip", n)
+		}
+	}
+}
+
+func TestPkcs7DecodeBad(t *testing.T) {
+	_, err := pkcs7DecodeCerts([]byte{0x30, 0x03, 0x02, 0x01, 0x01})
+	if err == nil {
+		t.Error("Expected to fail decoding garbage")
+	}
+}
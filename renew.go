@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+)
+
+const renewDefaultFraction = 7.0 / 8.0
+
+// When to renew the node certificate and what to do with the key.
+// With margin-seconds, renewal happens that long before expiry,
+// otherwise after fraction of the lifetime has passed. The key is
+// either "rotate" (the default) or "keep".
+type renewconfig struct {
+	Fraction      float64 `json:"fraction"`
+	MarginSeconds int64   `json:"margin-seconds"`
+	Key           string  `json:"key"`
+}
+
+// Remote request to renew right away, published on
+// joonos/<node>/renew. Key overrides the key policy if set.
+type renewCommand struct {
+	Key string `json:"key"`
+}
+
+func (c renewconfig) renewTime(leaf *x509.Certificate) time.Time {
+	if c.MarginSeconds > 0 {
+		return leaf.NotAfter.Add(-time.Duration(c.MarginSeconds) * time.Second)
+	}
+
+	fraction := c.Fraction
+	if fraction <= 0 || fraction > 1 {
+		fraction = renewDefaultFraction
+	}
+
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	return leaf.NotBefore.Add(time.Duration(fraction * float64(lifetime)))
+}
+
+func (c renewconfig) rotateKey(override string) (bool, error) {
+	policy := c.Key
+	if len(override) > 0 {
+		policy = override
+	}
+
+	switch policy {
+	case "", "rotate":
+		return true, nil
+	case "keep":
+		return false, nil
+	}
+
+	return false, fmt.Errorf("unknown key policy %s", policy)
+}
+
+func certRenew(configpath string, keyPolicy string, timeout time.Duration) error {
+	config, err := configLoad(configpath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	state, err := stateLoad(config)
+	if err != nil {
+		return fmt.Errorf("failed to initialize state: %w", err)
+	}
+
+	state.clockskew, err = clockBootstrap(config.Clock, state)
+	if err != nil {
+		fmt.Println("Clock problem:", err)
+	}
+
+	rotate, err := config.Renewal.rotateKey(keyPolicy)
+	if err != nil {
+		return err
+	}
+
+	mqttchans := mqttStartNode()
+	mqttchans.params <- state.mqttparams()
+
+	enr, err := enrollerFromConfig(config.Enrollment, mqttchans)
+	if err != nil {
+		return fmt.Errorf("failed to set up enrollment: %w", err)
+	}
+
+	var start <-chan time.Time
+	if _, isEst := enr.(enrollerEst); isEst {
+		start = time.After(0)
+	}
+
+	deadline := time.After(timeout)
+	requested := false
+	var csr *x509.CertificateRequest
+
+	for {
+		select {
+		case <-mqttchans.didconnect:
+			if !requested {
+				start = time.After(0)
+			}
+		case msg := <-mqttchans.messages:
+			fmt.Printf("MQTT: %s\n", msg)
+		case <-start:
+			requested = true
+			isRenewal := state.nodecert != nil && state.nodecerterr == nil
+			// A CSR waiting for approval is sent again as is
+			if csr == nil {
+				csr, err = state.csr(rotate)
+				if err != nil {
+					return fmt.Errorf("failed to generate CSR: %w", err)
+				}
+			}
+			enr.enroll(csr, state.esttlsconfig(), isRenewal)
+		case certs := <-enr.certs():
+			err = state.setCertificates(certs)
+			if err != nil {
+				return fmt.Errorf("did not accept certificate: %w", err)
+			}
+			enr.clear()
+			fmt.Println("Renewed certificate:", certDesc(certs[0]))
+			return nil
+		case err := <-enr.failures():
+			var pending enrollPendingError
+			if !errors.As(err, &pending) {
+				return fmt.Errorf("enrollment failed: %w", err)
+			}
+			fmt.Println(err)
+			if _, isEst := enr.(enrollerEst); isEst {
+				start = time.After(30 * time.Second)
+			}
+		case <-deadline:
+			return fmt.Errorf("no certificate received in %s", timeout)
+		}
+	}
+}
+
+func certRenewSubcommand() *subcommand {
+	flagset := flag.NewFlagSet("cert-renew", flag.ExitOnError)
+	args := commonArgs{}
+	commonFlags(flagset, &args)
+
+	key := flagset.String("key", "", "rotate or keep the key, instead of the configured policy")
+	seconds := flagset.Int64("seconds", 300, "how long to wait for the certificate, in seconds")
+
+	run := func() error {
+		return certRenew(args.config, *key, time.Duration(*seconds)*time.Second)
+	}
+
+	renewCommand := subcommand{
+		flagset: flagset,
+		run:     run,
+	}
+	return &renewCommand
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestRenewTime(t *testing.T) {
+	notBefore := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	leaf := &x509.Certificate{
+		NotBefore: notBefore,
+		NotAfter:  notBefore.Add(80 * 24 * time.Hour),
+	}
+
+	cases := []struct {
+		conf     renewconfig
+		expected time.Time
+	}{
+		{renewconfig{}, notBefore.Add(70 * 24 * time.Hour)},
+		{renewconfig{Fraction: 0.5}, notBefore.Add(40 * 24 * time.Hour)},
+		{renewconfig{Fraction: 0.5, MarginSeconds: 86400}, notBefore.Add(79 * 24 * time.Hour)},
+	}
+
+	for _, c := range cases {
+		renewTime := c.conf.renewTime(leaf)
+		if !renewTime.Equal(c.expected) {
+			t.Errorf("Expected %s for %+v, got %s", c.expected, c.conf, renewTime)
+		}
+	}
+}
+
+func TestRenewRotateKey(t *testing.T) {
+	rotate, err := renewconfig{}.rotateKey("")
+	if err != nil || !rotate {
+		t.Errorf("Expected to rotate by default")
+	}
+
+	rotate, err = renewconfig{Key: "rotate"}.rotateKey("keep")
+	if err != nil || rotate {
+		t.Errorf("Expected the override to keep the key")
+	}
+
+	_, err = renewconfig{Key: "sometimes"}.rotateKey("")
+	if err == nil {
+		t.Errorf("Expected to fail with an unknown policy")
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"time"
@@ -22,6 +24,11 @@ func runWithConfig(configPath string) error {
 
 	fmt.Println("State initialized")
 
+	state.clockskew, err = clockBootstrap(config.Clock, state)
+	if err != nil {
+		fmt.Println("Clock problem:", err)
+	}
+
 	if state.nodecert == nil {
 		fmt.Println("Node certificate is not present.")
 	}
@@ -35,7 +42,31 @@ func runWithConfig(configPath string) error {
 	mqttchans := mqttStartNode()
 	mqttchans.params <- state.mqttparams()
 
+	enr, err := enrollerFromConfig(config.Enrollment, mqttchans)
+	if err != nil {
+		return fmt.Errorf("failed to set up enrollment: %w", err)
+	}
+
 	var renewcert <-chan time.Time
+	var renewal certrenewal
+	var renewKey string
+	// The latest CSR, and the one held back by the CA for approval,
+	// which is sent again instead of a new one
+	var lastCsr, heldCsr *x509.CertificateRequest
+	certcheck := time.NewTicker(time.Hour)
+
+	publishCertstatus := func() {
+		status := certstatusGet(state, renewal, config.CertAlarmFraction)
+		select {
+		case mqttchans.certstatus <- status:
+		default:
+			// Not connected, the next check will try again
+		}
+	}
+	if _, isEst := enr.(enrollerEst); isEst {
+		// EST does not need to wait for the MQTT connection
+		renewcert = time.After(state.certRenewTime())
+	}
 
 	go func() {
 		for {
@@ -55,11 +86,12 @@ func runWithConfig(configPath string) error {
 				// Supposedly we intend to keep the current certificate for
 				// some time, so let's be nice and clear out any dangling
 				// previous CSR.
-				mqttchans.csrs <- nil
+				enr.clear()
 			}
 
 			if !didconnect.provisioning {
 				mqttchans.sysdesc <- sysdescLoad()
+				mqttchans.certstatus <- certstatusGet(state, renewal, config.CertAlarmFraction)
 			}
 
 			// Could be rather immediately, or also quite some time in
@@ -70,25 +102,70 @@ func runWithConfig(configPath string) error {
 			fmt.Printf("MQTT: %s\n", msg)
 		case <-renewcert:
 			fmt.Println("Should renew the certificate")
-			csr, err := state.csr()
+			renewal.started()
+			if heldCsr != nil {
+				enr.enroll(heldCsr, state.esttlsconfig(), state.nodecert != nil && state.nodecerterr == nil)
+				publishCertstatus()
+				renewcert = time.After(time.Hour)
+				break
+			}
+			isRenewal := state.nodecert != nil && state.nodecerterr == nil
+			rotate, err := config.Renewal.rotateKey(renewKey)
+			if err != nil {
+				fmt.Printf("Bad key policy, rotating the key: %v\n", err)
+				rotate = true
+			}
+			renewKey = ""
+			csr, err := state.csr(rotate)
 			if err != nil {
 				fmt.Printf("Failed to generate CSR: %v\n", err)
+				renewal.failed(err)
 			} else {
-				mqttchans.csrs <- csr
+				lastCsr = csr
+				enr.enroll(csr, state.esttlsconfig(), isRenewal)
 			}
+			publishCertstatus()
 			// Will retry after some time, in case there is no reply
 			renewcert = time.After(time.Hour)
 
-		case certs := <-mqttchans.certs:
+		case certs := <-enr.certs():
 			err = state.setCertificates(certs)
 			if err != nil {
 				fmt.Printf("Did not accept certificate: %v\n", err)
+				renewal.failed(err)
 			} else {
 				fmt.Printf("Updated certificate\n")
-				mqttchans.csrs <- nil
+				renewal.succeeded()
+				heldCsr = nil
+				enr.clear()
 				mqttchans.params <- state.mqttparams()
 				renewcert = time.After(state.certRenewTime())
 			}
+		case err := <-enr.failures():
+			var pending enrollPendingError
+			if errors.As(err, &pending) {
+				fmt.Printf("Enrollment waiting: %v\n", err)
+				renewal.waiting(err)
+				heldCsr = lastCsr
+				publishCertstatus()
+				// The CA publishes the certificate over MQTT once
+				// approved, while EST needs the CSR to be repeated
+				renewcert = time.After(10 * time.Minute)
+				break
+			}
+			fmt.Printf("Enrollment failed: %v\n", err)
+			renewal.failed(err)
+			heldCsr = nil
+			// The CSR is not going to be accepted as is
+			enr.clear()
+			publishCertstatus()
+		case <-certcheck.C:
+			publishCertstatus()
+		case cmd := <-mqttchans.renewcmds:
+			fmt.Println("Renewal requested remotely")
+			renewKey = cmd.Key
+			heldCsr = nil
+			renewcert = time.After(0)
 		case upg := <-mqttchans.upgcmds:
 			if len(config.Upgrade) > 0 {
 				go upgrade(config.Upgrade, upg)
@@ -1,11 +1,10 @@
 package main
 
 import (
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"flag"
 	"fmt"
 	"os"
@@ -19,7 +18,9 @@ type state struct {
 	nodename    string
 	nodecert    *tls.Certificate
 	nodecerterr error
-	csrkey      interface{}
+	keys        keystore
+	csrkey      crypto.Signer
+	clockskew   time.Duration
 }
 
 func stateLoad(config config) (state, error) {
@@ -36,6 +37,25 @@ func stateLoad(config config) (state, error) {
 		)
 	}
 
+	err = config.Tls.check()
+	if err != nil {
+		return res, fmt.Errorf("bad TLS policy: %w", err)
+	}
+
+	if config.Pkcs11 == nil {
+		for _, path := range []string{config.Nodekey(), config.NodekeyPending()} {
+			err = keycryptCheckFile(path)
+			if err != nil {
+				return res, fmt.Errorf("unsafe node key: %w", err)
+			}
+		}
+	}
+
+	keys, err := keystoreFromConfig(config)
+	if err != nil {
+		return res, fmt.Errorf("failed to open key store: %w", err)
+	}
+
 	cacert, err := certLoadOneFromPath(config.Cacert)
 	if err != nil {
 		return res, fmt.Errorf(
@@ -64,10 +84,7 @@ func stateLoad(config config) (state, error) {
 	}
 	provcert.Leaf = provcertLeaf
 
-	nodecert, nodecerterr := stateLoadNodecert(
-		config.Nodecert(),
-		config.Nodekey(),
-	)
+	nodecert, nodecerterr := stateLoadNodecert(config.Nodecert(), keys)
 	// Nodecerterr is something that is not handled at this time.
 	// The caller is expected to check it and make do without a
 	// good node cert, if necessary
@@ -87,37 +104,42 @@ func stateLoad(config config) (state, error) {
 	res.nodecert = nodecert
 	res.nodecerterr = nodecerterr
 	res.nodename = nodename
+	res.keys = keys
 
 	return res, nil
 }
 
-func stateLoadNodecert(certpath string, keypath string) (*tls.Certificate, error) {
-	nodecert, err := tls.LoadX509KeyPair(
-		certpath,
-		keypath,
-	)
+func stateLoadNodecert(certpath string, keys keystore) (*tls.Certificate, error) {
+	nodecert := tls.Certificate{}
 
+	certs, err := certLoadFromPath(certpath)
 	if err != nil {
 		return &nodecert, err
 	}
 
-	leaf, err := x509.ParseCertificate(nodecert.Certificate[0])
-	if err != nil {
-		// This is not really expected to happen, given how
-		// the tls package already managed to parse it. The
-		// certificate is returned along with the error, just
-		// in case it turns out to be useful. The remaining
-		// checks here can not be done.
-		return &nodecert, fmt.Errorf(
-			"failed to parse leaf certificate from %s: %w",
-			certpath,
-			err,
-		)
+	if len(certs) == 0 {
+		return &nodecert, fmt.Errorf("no certificates in %s", certpath)
+	}
+
+	for _, cert := range certs {
+		nodecert.Certificate = append(nodecert.Certificate, cert.Raw)
 	}
 
 	// At least MQTT code expects to use Subject from Leaf
 	// for producing the user name
-	nodecert.Leaf = leaf
+	nodecert.Leaf = certs[0]
+
+	key, err := keys.load()
+	if err != nil {
+		return &nodecert, err
+	}
+
+	err = certCheckKeyMatch(nodecert.Leaf, key)
+	if err != nil {
+		return &nodecert, fmt.Errorf("node key does not match %s: %w", certpath, err)
+	}
+
+	nodecert.PrivateKey = key
 
 	notAfter := nodecert.Leaf.NotAfter
 	if time.Now().After(notAfter) {
@@ -127,20 +149,29 @@ func stateLoadNodecert(certpath string, keypath string) (*tls.Certificate, error
 	return &nodecert, nil
 }
 
-func (s *state) csr() (*x509.CertificateRequest, error) {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
+// Produces a CSR for the node, either with a fresh key or with the
+// current node key
+func (s *state) csr(rotate bool) (*x509.CertificateRequest, error) {
+	template, err := csrTemplate(
+		s.config.Csr,
+		csrValuesLoad(s.nodename, s.config.Tags),
+	)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to prepare CSR contents: %w", err)
 	}
 
-	subject := pkix.Name{
-		CommonName: s.nodename,
-	}
-	template := x509.CertificateRequest{
-		Subject: subject,
+	var key crypto.Signer
+	renewal := s.nodecert != nil && s.nodecerterr == nil
+	if renewal && !rotate {
+		key = s.nodecert.PrivateKey.(crypto.Signer)
+	} else {
+		key, err = s.keys.generate()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	csrb, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
+	csrb, err := x509.CreateCertificateRequest(rand.Reader, template, key)
 	if err != nil {
 		return nil, err
 	}
@@ -150,6 +181,24 @@ func (s *state) csr() (*x509.CertificateRequest, error) {
 		return nil, err
 	}
 
+	tokenFile := s.config.Enrollment.TokenFile
+	if len(tokenFile) > 0 && !renewal {
+		token, err := enrolltokenLoad(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load enrollment token: %w", err)
+		}
+
+		proof, err := enrolltokenProof(enrolltokenHash(token), csr.RawSubjectPublicKeyInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		csr, err = csrAddChallengePassword(csr, proof, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	s.csrkey = key
 
 	return csr, nil
@@ -165,7 +214,9 @@ func (s state) mqttparams() mqttparams {
 }
 
 func (s *state) setCertificate(cert *x509.Certificate, intermediates []*x509.Certificate) error {
-	chain, err := certVerifyLeafIntermediatesCa(cert, intermediates, s.cacert)
+	// Node certificates are for client authentication, which is
+	// not accepted with the default of ExtKeyUsageServerAuth
+	chain, err := certVerifyLeafIntermediatesCa(cert, intermediates, s.cacert, x509.ExtKeyUsageClientAuth)
 	if err != nil {
 		return fmt.Errorf("failed to verify the supplied certificate: %w", err)
 	}
@@ -175,9 +226,12 @@ func (s *state) setCertificate(cert *x509.Certificate, intermediates []*x509.Cer
 		return fmt.Errorf("could not match certificate to CSR key: %w", err)
 	}
 
-	err = certWriteKey(s.config.Nodekey(), s.csrkey)
-	if err != nil {
-		return fmt.Errorf("failed to store key: %w", err)
+	keptKey := s.nodecert != nil && s.nodecert.PrivateKey == s.csrkey
+	if !keptKey {
+		err = s.keys.commit(s.csrkey)
+		if err != nil {
+			return fmt.Errorf("failed to store key: %w", err)
+		}
 	}
 
 	err = certWriteChain(s.config.Nodecert(), chain[:len(chain)-1])
@@ -186,10 +240,7 @@ func (s *state) setCertificate(cert *x509.Certificate, intermediates []*x509.Cer
 	}
 
 	// Reload the certificates right away
-	s.nodecert, s.nodecerterr = stateLoadNodecert(
-		s.config.Nodecert(),
-		s.config.Nodekey(),
-	)
+	s.nodecert, s.nodecerterr = stateLoadNodecert(s.config.Nodecert(), s.keys)
 
 	return nil
 }
@@ -213,7 +264,17 @@ func (s state) tlscert() *tls.Certificate {
 	return cert
 }
 
+// TLS configuration for the broker
 func (s state) tlsconfig() *tls.Config {
+	return s.tlsconfigFor(s.config.Tls.Broker)
+}
+
+// TLS configuration for the EST server
+func (s state) esttlsconfig() *tls.Config {
+	return s.tlsconfigFor(s.config.Tls.Est)
+}
+
+func (s state) tlsconfigFor(endpoint tlsendpoint) *tls.Config {
 	rootCAs := x509.NewCertPool()
 	rootCAs.AddCert(s.cacert)
 
@@ -222,6 +283,13 @@ func (s state) tlsconfig() *tls.Config {
 		RootCAs:      rootCAs,
 	}
 
+	if s.clockskew != 0 {
+		config.Time = s.now
+	}
+
+	// Already checked by stateLoad
+	s.config.Tls.apply(config, endpoint)
+
 	return config
 }
 
@@ -230,10 +298,12 @@ func (s state) certRenewTime() time.Duration {
 		return 0
 	}
 
-	certDuration := s.nodecert.Leaf.NotAfter.Sub(s.nodecert.Leaf.NotBefore)
-	renewTime := s.nodecert.Leaf.NotBefore.Add(7 * certDuration / 8)
+	return s.config.Renewal.renewTime(s.nodecert.Leaf).Sub(s.now())
+}
 
-	return time.Until(renewTime)
+// The current time, corrected by the skew found by clockBootstrap
+func (s state) now() time.Time {
+	return time.Now().Add(s.clockskew)
 }
 
 func stateShow(configpath string) error {
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Restrictions for the TLS connections made to the broker and other
+// services. The version and cipher suites apply to every connection,
+// while the server name and pins are given separately for the broker,
+// the EST server and the time server.
+type tlspolicy struct {
+	MinVersion   string      `json:"min-version"`
+	CipherSuites []string    `json:"cipher-suites"`
+	Broker       tlsendpoint `json:"broker"`
+	Est          tlsendpoint `json:"est"`
+	Clock        tlsendpoint `json:"clock"`
+}
+
+// Checks of one server. Pins are SHA-256 hashes of the
+// SubjectPublicKeyInfo of some certificate in the chain of the server,
+// in hex or base64.
+type tlsendpoint struct {
+	ServerName string   `json:"server-name"`
+	PinSha256  []string `json:"pin-sha256"`
+}
+
+var tlspolicyVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func tlspolicyCipherSuite(name string) (uint16, error) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+	}
+
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			return 0, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+	}
+
+	return 0, fmt.Errorf("unknown cipher suite %s", name)
+}
+
+func tlspolicyDecodePin(pin string) ([]byte, error) {
+	pin = strings.TrimPrefix(pin, "sha256/")
+
+	decoded, err := hex.DecodeString(pin)
+	if err != nil {
+		decoded, err = base64.StdEncoding.DecodeString(pin)
+	}
+
+	if err != nil || len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("expected a SHA-256 hash in hex or base64, got %s", pin)
+	}
+
+	return decoded, nil
+}
+
+func tlspolicyCheckPins(pins [][]byte, rawCerts [][]byte) error {
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if string(pin) == string(sum[:]) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("no certificate of the server matches the pinned keys")
+}
+
+// Checks the whole policy, including the endpoints which are not
+// connected to yet
+func (p tlspolicy) check() error {
+	for _, endpoint := range []tlsendpoint{p.Broker, p.Est, p.Clock} {
+		err := p.apply(&tls.Config{}, endpoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Applies the policy to conf, for a connection to endpoint. Validation
+// of the server certificate is done as usual, the pins are checked in
+// addition to it. VerifyPeerCertificate is not called for resumed
+// sessions, which are not used as no session cache is set.
+func (p tlspolicy) apply(conf *tls.Config, endpoint tlsendpoint) error {
+	if len(p.MinVersion) > 0 {
+		version, found := tlspolicyVersions[p.MinVersion]
+		if !found {
+			return fmt.Errorf("unsupported TLS version %s", p.MinVersion)
+		}
+		conf.MinVersion = version
+	}
+
+	if len(p.CipherSuites) > 0 {
+		suites := make([]uint16, 0, len(p.CipherSuites))
+		for _, name := range p.CipherSuites {
+			suite, err := tlspolicyCipherSuite(name)
+			if err != nil {
+				return err
+			}
+			suites = append(suites, suite)
+		}
+		conf.CipherSuites = suites
+	}
+
+	if len(endpoint.ServerName) > 0 {
+		conf.ServerName = endpoint.ServerName
+	}
+
+	if len(endpoint.PinSha256) > 0 {
+		pins := make([][]byte, 0, len(endpoint.PinSha256))
+		for _, pin := range endpoint.PinSha256 {
+			decoded, err := tlspolicyDecodePin(pin)
+			if err != nil {
+				return err
+			}
+			pins = append(pins, decoded)
+		}
+
+		conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return tlspolicyCheckPins(pins, rawCerts)
+		}
+	}
+
+	return nil
+}
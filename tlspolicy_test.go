@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestTlspolicyApply(t *testing.T) {
+	policy := tlspolicy{
+		MinVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		Broker:       tlsendpoint{ServerName: "mqtt.example.com"},
+		Est:          tlsendpoint{ServerName: "est.example.com"},
+	}
+
+	conf := tls.Config{}
+	err := policy.apply(&conf, policy.Broker)
+	if err != nil {
+		t.Fatalf("Failed to apply policy: %v", err)
+	}
+
+	if conf.MinVersion != tls.VersionTLS13 {
+		t.Errorf("Expected TLS 1.3 as minimum version")
+	}
+
+	if len(conf.CipherSuites) != 1 || conf.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("Unexpected cipher suites %v", conf.CipherSuites)
+	}
+
+	if conf.ServerName != "mqtt.example.com" {
+		t.Errorf("Unexpected server name %s", conf.ServerName)
+	}
+
+	// The broker settings do not leak to the other servers
+	conf = tls.Config{}
+	err = policy.apply(&conf, policy.Clock)
+	if err != nil {
+		t.Fatalf("Failed to apply policy: %v", err)
+	}
+
+	if conf.MinVersion != tls.VersionTLS13 || len(conf.ServerName) > 0 || conf.VerifyPeerCertificate != nil {
+		t.Errorf("Expected only the version and cipher suites for the clock")
+	}
+
+	bad := []tlspolicy{
+		{MinVersion: "1.0"},
+		{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{Est: tlsendpoint{PinSha256: []string{"abcd"}}},
+	}
+	for _, p := range bad {
+		if p.check() == nil {
+			t.Errorf("Expected %+v to be rejected", p)
+		}
+	}
+}
+
+func TestTlspolicyPins(t *testing.T) {
+	certs, err := certLoadFromPath("test-files/unprovisioned.cert.pem")
+	if err != nil {
+		t.Fatalf("Failed to load certificates: %v", err)
+	}
+
+	rawCerts := [][]byte{certs[0].Raw, certs[1].Raw}
+	intermediatePin := certKeyFingerprint(certs[1].RawSubjectPublicKeyInfo)
+
+	conf := tls.Config{}
+	err = tlspolicy{}.apply(&conf, tlsendpoint{PinSha256: []string{intermediatePin}})
+	if err != nil {
+		t.Fatalf("Failed to apply policy: %v", err)
+	}
+
+	if conf.VerifyPeerCertificate(rawCerts, nil) != nil {
+		t.Error("Expected the pinned intermediate to be accepted")
+	}
+
+	otherPin := certKeyFingerprint([]byte("something else"))
+	err = tlspolicy{}.apply(&conf, tlsendpoint{PinSha256: []string{otherPin}})
+	if err != nil {
+		t.Fatalf("Failed to apply policy: %v", err)
+	}
+
+	if conf.VerifyPeerCertificate(rawCerts, nil) == nil {
+		t.Error("Expected a connection without the pinned key to be rejected")
+	}
+}